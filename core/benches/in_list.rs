@@ -0,0 +1,53 @@
+//! Compares hash-set and linear matching of a long IN list over a full
+//! table scan. Run with `cargo bench --bench in_list`.
+
+use std::time::{Duration, Instant};
+
+use sql_core::{parse_query, Engine, Value, ValueType};
+
+const ROWS: i64 = 100_000;
+const LIST: i64 = 500;
+const RUNS: u32 = 5;
+
+fn engine(in_set_threshold: usize) -> Engine {
+    let mut engine = Engine::new();
+    engine.in_set_threshold = in_set_threshold;
+    // Without an index the IN list is matched against every row.
+    engine.auto_index = false;
+    engine.create_table("events", vec![("id".into(), ValueType::Int)]);
+    for id in 0..ROWS {
+        engine
+            .insert_into("events", vec![Value::Int(id)], None)
+            .unwrap();
+    }
+    engine
+}
+
+fn bench(in_set_threshold: usize) -> Duration {
+    let mut engine = engine(in_set_threshold);
+    // Every other value exists, so half the list matches.
+    let list: Vec<String> = (0..LIST).map(|i| (i * 2).to_string()).collect();
+    let sql = format!("SELECT id FROM events WHERE id IN ({})", list.join(", "));
+    let mut best = Duration::MAX;
+    for _ in 0..RUNS {
+        let query = parse_query(&sql).unwrap().1;
+        let start = Instant::now();
+        let rows = engine.execute(query).unwrap();
+        best = best.min(start.elapsed());
+        assert_eq!(rows.len(), LIST as usize);
+    }
+    best
+}
+
+fn main() {
+    for (label, threshold) in [("hash set", 0), ("linear", usize::MAX)] {
+        println!(
+            "IN list of {} over {} rows, {}: best of {} runs {:?}",
+            LIST,
+            ROWS,
+            label,
+            RUNS,
+            bench(threshold)
+        );
+    }
+}
@@ -0,0 +1,62 @@
+//! Compares a sequential full scan with a parallel one on a table well
+//! above `DEFAULT_PARALLEL_SCAN_THRESHOLD`. Run with
+//! `cargo bench --bench parallel_scan`.
+
+use std::thread;
+use std::time::{Duration, Instant};
+
+use sql_core::{parse_query, Engine, Value, ValueType, DEFAULT_PARALLEL_SCAN_THRESHOLD};
+
+const ROWS: i64 = 1_000_000;
+const RUNS: u32 = 5;
+
+fn engine(scan_workers: usize) -> Engine {
+    let mut engine = Engine::new();
+    engine.scan_workers = scan_workers;
+    engine.create_table(
+        "events",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("kind".into(), ValueType::Text),
+        ],
+    );
+    for id in 0..ROWS {
+        let kind = format!("kind-{}", id % 100);
+        engine
+            .insert_into("events", vec![Value::Int(id), Value::Text(kind)], None)
+            .unwrap();
+    }
+    engine
+}
+
+fn bench(scan_workers: usize) -> Duration {
+    let mut engine = engine(scan_workers);
+    let mut best = Duration::MAX;
+    for _ in 0..RUNS {
+        // kind is not indexed, so every row is tested.
+        let query = parse_query("SELECT id FROM events WHERE kind = 'kind-7'")
+            .unwrap()
+            .1;
+        let start = Instant::now();
+        let rows = engine.execute(query).unwrap();
+        best = best.min(start.elapsed());
+        assert_eq!(rows.len(), ROWS as usize / 100);
+    }
+    best
+}
+
+fn main() {
+    assert!(ROWS as usize > DEFAULT_PARALLEL_SCAN_THRESHOLD);
+    // At least two workers, so the comparison is meaningful even where
+    // only one CPU is reported.
+    let workers = thread::available_parallelism().map_or(4, |n| n.get().max(2));
+    for scan_workers in [1, workers] {
+        println!(
+            "full scan of {} rows, {} worker(s): best of {} runs {:?}",
+            ROWS,
+            scan_workers,
+            RUNS,
+            bench(scan_workers)
+        );
+    }
+}
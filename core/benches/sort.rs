@@ -0,0 +1,57 @@
+//! Compares stable and unstable ORDER BY sorts on a large table with many
+//! ties. Run with `cargo bench --bench sort`.
+
+use std::time::{Duration, Instant};
+
+use sql_core::{parse_query, Engine, Value, ValueType};
+
+const ROWS: i64 = 200_000;
+const RUNS: u32 = 5;
+
+fn engine(stable_sort: bool) -> Engine {
+    let mut engine = Engine::new();
+    engine.stable_sort = stable_sort;
+    engine.auto_index = false;
+    engine.create_table(
+        "events",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("bucket".into(), ValueType::Int),
+        ],
+    );
+    for id in 0..ROWS {
+        // A cheap scramble so the input is not already sorted.
+        let bucket = (id * 7_919) % 1_000;
+        engine
+            .insert_into("events", vec![Value::Int(id), Value::Int(bucket)], None)
+            .unwrap();
+    }
+    engine
+}
+
+fn bench(stable_sort: bool) -> Duration {
+    let mut engine = engine(stable_sort);
+    let mut best = Duration::MAX;
+    for _ in 0..RUNS {
+        let query = parse_query("SELECT id FROM events ORDER BY bucket")
+            .unwrap()
+            .1;
+        let start = Instant::now();
+        let rows = engine.execute(query).unwrap();
+        best = best.min(start.elapsed());
+        assert_eq!(rows.len(), ROWS as usize);
+    }
+    best
+}
+
+fn main() {
+    for (label, stable_sort) in [("stable", true), ("unstable", false)] {
+        println!(
+            "ORDER BY over {} rows, {} sort: best of {} runs {:?}",
+            ROWS,
+            label,
+            RUNS,
+            bench(stable_sort)
+        );
+    }
+}
@@ -1,6 +1,13 @@
-use std::collections::HashMap;
+use std::cmp::Ordering;
+use std::collections::{HashMap, HashSet};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
 
-use crate::parser::{Condition, Operator, Query, SelectQuery};
+use crate::functions;
+use crate::parser::{
+    ArithOp, Condition, Expr, Operator, OrderBy, Query, SelectQuery, SetOperator, SetQuery,
+};
+use regex::{Regex, RegexBuilder};
 use serde::{Deserialize, Serialize};
 
 #[derive(Debug, Clone, PartialEq, Eq, Hash, Serialize, Deserialize)]
@@ -42,6 +49,47 @@ pub enum EngineError {
         expected: ValueType,
         found: ValueType,
     },
+    /// The query's intermediate results exceeded `Engine::memory_limit`.
+    MemoryLimitExceeded {
+        limit: usize,
+    },
+    /// The operands of a set operation return different column counts.
+    ColumnCountMismatch {
+        left: usize,
+        right: usize,
+    },
+    /// An IN list has more entries than `Engine::max_in_list`.
+    InListTooLarge {
+        limit: usize,
+        found: usize,
+    },
+    /// The estimated cost of a query exceeds `Engine::cost_budget`.
+    CostBudgetExceeded {
+        budget: usize,
+        estimate: usize,
+    },
+    /// A REGEXP pattern failed to compile.
+    InvalidRegex {
+        pattern: String,
+        message: String,
+    },
+    /// A case-insensitive identifier matched more than one table or column.
+    AmbiguousIdentifier(String),
+    /// Integer division by zero under `DivisionByZero::Error`.
+    DivisionByZero,
+    /// An arithmetic operator got non-integer operands or overflowed.
+    InvalidOperands {
+        op: String,
+        message: String,
+    },
+    /// An INSERT column list left out a column under
+    /// `OmittedColumns::Error`.
+    MissingColumn(String),
+    UnknownFunction(String),
+    InvalidArgument {
+        function: String,
+        message: String,
+    },
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -52,11 +100,43 @@ pub struct Column {
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Table {
+    /// Columns in declaration order. `SELECT *` and serialized tables keep
+    /// this order, so positional access is stable across reloads.
     pub columns: Vec<Column>,
+    /// Rows in insertion order. Every access path (full scan, parallel
+    /// scan, index lookup) returns matches in this order, so a SELECT
+    /// without ORDER BY yields rows as they were inserted.
     pub rows: Vec<Row>,
+    #[serde(with = "index_entries")]
     pub indices: HashMap<String, HashMap<Value, Vec<usize>>>,
 }
 
+/// Serializes index maps as entry lists, since `Value` keys are not valid
+/// keys in formats such as JSON.
+mod index_entries {
+    use super::Value;
+    use serde::{Deserialize, Deserializer, Serialize, Serializer};
+    use std::collections::HashMap;
+
+    type Indices = HashMap<String, HashMap<Value, Vec<usize>>>;
+
+    pub fn serialize<S: Serializer>(indices: &Indices, s: S) -> Result<S::Ok, S::Error> {
+        let entries: HashMap<&String, Vec<(&Value, &Vec<usize>)>> = indices
+            .iter()
+            .map(|(col, index)| (col, index.iter().collect()))
+            .collect();
+        entries.serialize(s)
+    }
+
+    pub fn deserialize<'de, D: Deserializer<'de>>(d: D) -> Result<Indices, D::Error> {
+        let entries: HashMap<String, Vec<(Value, Vec<usize>)>> = HashMap::deserialize(d)?;
+        Ok(entries
+            .into_iter()
+            .map(|(col, index)| (col, index.into_iter().collect()))
+            .collect())
+    }
+}
+
 impl Table {
     pub fn new(columns: Vec<(String, ValueType)>) -> Self {
         let cols = columns
@@ -82,6 +162,16 @@ impl Table {
         }
     }
 
+    /// Rebuilds every existing index from the table's rows, discarding
+    /// whatever the index held before. Returns the number of indexes.
+    pub fn reindex(&mut self) -> usize {
+        let columns: Vec<String> = self.indices.keys().cloned().collect();
+        for column in &columns {
+            self.create_index(column);
+        }
+        columns.len()
+    }
+
     pub fn insert(&mut self, values: Row) {
         let row_idx = self.rows.len();
         for (col_idx, value) in values.iter().enumerate() {
@@ -95,22 +185,226 @@ impl Table {
     }
 }
 
-#[derive(Default)]
+/// An `Expr` with its column references resolved to row positions, built
+/// once per query by `Engine::resolve`.
+enum Resolved<'q> {
+    Column(usize),
+    Literal(&'q Value),
+    Function {
+        name: &'q str,
+        args: Vec<Resolved<'q>>,
+    },
+    JsonGet {
+        expr: Box<Resolved<'q>>,
+        key: &'q Value,
+        as_text: bool,
+    },
+    Binary {
+        op: ArithOp,
+        left: Box<Resolved<'q>>,
+        right: Box<Resolved<'q>>,
+    },
+}
+
+/// Result of `Engine::reindex`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ReindexStats {
+    /// Indexes rebuilt.
+    pub indexes: usize,
+    /// Rows read to rebuild them.
+    pub rows: usize,
+    pub elapsed: Duration,
+}
+
+/// Work done by a SELECT, as reported by `Engine::select_with_stats`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct ScanStats {
+    /// Rows read from the table: every row for a full scan, or only the
+    /// matches for an index lookup.
+    pub rows_scanned: usize,
+    /// Rows in the result, after OFFSET and LIMIT.
+    pub rows_returned: usize,
+    /// Whether the WHERE clause was answered from an index.
+    pub index_used: bool,
+}
+
+/// Rough per-query accounting of the bytes held by intermediate results.
+struct MemoryBudget {
+    limit: Option<usize>,
+    used: usize,
+}
+
+impl MemoryBudget {
+    fn new(limit: Option<usize>) -> Self {
+        Self { limit, used: 0 }
+    }
+
+    fn charge(&mut self, bytes: usize) -> Result<(), EngineError> {
+        self.used += bytes;
+        match self.limit {
+            Some(limit) if self.used > limit => Err(EngineError::MemoryLimitExceeded { limit }),
+            _ => Ok(()),
+        }
+    }
+}
+
+/// Approximate heap and inline size of a value.
+fn value_bytes(v: &Value) -> usize {
+    std::mem::size_of::<Value>()
+        + match v {
+            Value::Text(s) => s.len(),
+            _ => 0,
+        }
+}
+
+/// Approximate heap and inline size of a materialized row.
+fn row_bytes(row: &Row) -> usize {
+    row.iter().map(value_bytes).sum::<usize>() + std::mem::size_of::<Row>()
+}
+
+/// What integer division by zero evaluates to.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub enum DivisionByZero {
+    /// Fail the query with `EngineError::DivisionByZero`.
+    #[default]
+    Error,
+    /// Evaluate to NULL, like `SAFE_DIVIDE`.
+    Null,
+    /// Evaluate to a fixed value, e.g. `Value::Int(0)`.
+    Sentinel(Value),
+}
+
+/// What an INSERT with a column list stores in the columns it leaves out.
+/// Columns carry no DEFAULT or NOT NULL constraints, so the usual
+/// DEFAULT-then-NULL-then-error chain always ends at NULL.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub enum OmittedColumns {
+    /// Store NULL.
+    #[default]
+    Null,
+    /// Reject the insert with `EngineError::MissingColumn`.
+    Error,
+}
+
 pub struct Engine {
     pub tables: HashMap<String, Table>,
+    /// Upper bound in bytes on the intermediate results of a single query.
+    /// `None` disables the check.
+    pub memory_limit: Option<usize>,
+    /// Number of threads used to filter large tables. 1 keeps scans
+    /// single-threaded.
+    pub scan_workers: usize,
+    /// Tables with fewer rows than this are always scanned on the calling
+    /// thread, where spawning workers would cost more than it saves.
+    pub parallel_scan_threshold: usize,
+    /// Resolve table and column names ignoring ASCII case, for clients
+    /// coming from case-insensitive databases. Off by default.
+    pub case_insensitive: bool,
+    /// Maximum number of entries accepted in an IN list.
+    pub max_in_list: usize,
+    /// IN lists longer than this are matched through a hash set instead of
+    /// a linear comparison per row.
+    pub in_set_threshold: usize,
+    /// Queries whose `estimate_cost` exceeds this are rejected before they
+    /// run. `None` disables the check.
+    pub cost_budget: Option<usize>,
+    /// Result of `x / 0`. Defaults to an error.
+    pub division_by_zero: DivisionByZero,
+    /// Build an index on the first column of every table created with
+    /// `create_table`, which serves as the table's key. Disable to save
+    /// memory; indexes are then only built by explicit `create_index`.
+    pub auto_index: bool,
+    /// Handling of columns missing from an INSERT column list.
+    pub omitted_columns: OmittedColumns,
+    /// Sort ORDER BY results stably, so rows with equal keys keep their
+    /// insertion order. Turning it off uses a faster unstable sort that
+    /// needs no scratch buffer but leaves ties in arbitrary order.
+    pub stable_sort: bool,
+    /// Compiled REGEXP patterns, keyed by pattern and case flag.
+    regex_cache: Mutex<HashMap<(String, bool), Regex>>,
+}
+
+/// Number of compiled patterns kept before the regex cache is cleared.
+const REGEX_CACHE_SIZE: usize = 256;
+
+/// Default for `Engine::max_in_list`.
+pub const DEFAULT_MAX_IN_LIST: usize = 10_000;
+/// Default for `Engine::in_set_threshold`.
+pub const DEFAULT_IN_SET_THRESHOLD: usize = 16;
+
+/// Finds the position of name among names, exactly or, when
+/// case_insensitive is set, ignoring ASCII case. Folding that matches
+/// several names is an error rather than an arbitrary pick.
+fn resolve_name<'a, I>(
+    names: I,
+    name: &str,
+    case_insensitive: bool,
+) -> Result<Option<usize>, EngineError>
+where
+    I: IntoIterator<Item = &'a str>,
+{
+    if !case_insensitive {
+        return Ok(names.into_iter().position(|n| n == name));
+    }
+    let mut found = None;
+    for (pos, n) in names.into_iter().enumerate() {
+        if n.eq_ignore_ascii_case(name) {
+            if found.is_some() {
+                return Err(EngineError::AmbiguousIdentifier(name.to_string()));
+            }
+            found = Some(pos);
+        }
+    }
+    Ok(found)
+}
+
+fn find_column(
+    columns: &[Column],
+    name: &str,
+    case_insensitive: bool,
+) -> Result<usize, EngineError> {
+    resolve_name(
+        columns.iter().map(|c| c.name.as_str()),
+        name,
+        case_insensitive,
+    )?
+    .ok_or_else(|| EngineError::ColumnNotFound(name.to_string()))
+}
+
+/// Default for `Engine::parallel_scan_threshold`.
+pub const DEFAULT_PARALLEL_SCAN_THRESHOLD: usize = 10_000;
+
+impl Default for Engine {
+    fn default() -> Self {
+        Self::new()
+    }
 }
 
 impl Engine {
     pub fn new() -> Self {
         Self {
             tables: HashMap::new(),
+            memory_limit: None,
+            scan_workers: 1,
+            parallel_scan_threshold: DEFAULT_PARALLEL_SCAN_THRESHOLD,
+            case_insensitive: false,
+            max_in_list: DEFAULT_MAX_IN_LIST,
+            in_set_threshold: DEFAULT_IN_SET_THRESHOLD,
+            cost_budget: None,
+            division_by_zero: DivisionByZero::Error,
+            auto_index: true,
+            omitted_columns: OmittedColumns::Null,
+            stable_sort: true,
+            regex_cache: Mutex::new(HashMap::new()),
         }
     }
 
     pub fn create_table(&mut self, name: &str, columns: Vec<(String, ValueType)>) {
         let mut table = Table::new(columns);
-        if let Some(first_col) = table.columns.get(0) {
-            table.create_index(&first_col.name);
+        if self.auto_index {
+            if let Some(first_col) = table.columns.first().map(|c| c.name.clone()) {
+                table.create_index(&first_col);
+            }
         }
         self.tables.insert(name.to_string(), table);
     }
@@ -121,21 +415,22 @@ impl Engine {
         values: Row,
         columns: Option<Vec<String>>,
     ) -> Result<(), EngineError> {
-        match self.tables.get_mut(name) {
+        let key = self.table_name(name)?;
+        let case_insensitive = self.case_insensitive;
+        let omitted_columns = self.omitted_columns;
+        match self.tables.get_mut(&key) {
             Some(table) => {
                 if let Some(cols) = columns {
                     if cols.len() != values.len() {
                         return Err(EngineError::ValueCountMismatch);
                     }
                     let mut row = vec![Value::Null; table.columns.len()];
+                    let mut given = vec![false; table.columns.len()];
                     for (col_name, val) in cols.iter().zip(values.iter()) {
-                        let idx = table
-                            .columns
-                            .iter()
-                            .position(|c| c.name == *col_name)
-                            .ok_or_else(|| EngineError::ColumnNotFound(col_name.clone()))?;
+                        let idx = find_column(&table.columns, col_name, case_insensitive)?;
+                        given[idx] = true;
                         let col_def = &table.columns[idx];
-                        if col_def.col_type != val.value_type() {
+                        if *val != Value::Null && col_def.col_type != val.value_type() {
                             return Err(EngineError::TypeMismatch {
                                 column: col_def.name.clone(),
                                 expected: col_def.col_type.clone(),
@@ -144,6 +439,13 @@ impl Engine {
                         }
                         row[idx] = val.clone();
                     }
+                    if omitted_columns == OmittedColumns::Error {
+                        if let Some(idx) = given.iter().position(|g| !g) {
+                            return Err(EngineError::MissingColumn(
+                                table.columns[idx].name.clone(),
+                            ));
+                        }
+                    }
                     table.insert(row);
                     Ok(())
                 } else {
@@ -151,7 +453,7 @@ impl Engine {
                         return Err(EngineError::ValueCountMismatch);
                     }
                     for (col, val) in table.columns.iter().zip(values.iter()) {
-                        if col.col_type != val.value_type() {
+                        if *val != Value::Null && col.col_type != val.value_type() {
                             return Err(EngineError::TypeMismatch {
                                 column: col.name.clone(),
                                 expected: col.col_type.clone(),
@@ -167,12 +469,42 @@ impl Engine {
         }
     }
 
-    fn get_column_idx(table: &Table, name: &str) -> Result<usize, EngineError> {
-        table
-            .columns
-            .iter()
-            .position(|c| c.name == name)
-            .ok_or_else(|| EngineError::ColumnNotFound(name.to_string()))
+    /// Rebuilds every index on table from its rows, for recovering from
+    /// indexes that no longer match the data. Holding `&mut self` keeps
+    /// queries out until the rebuild is done.
+    pub fn reindex(&mut self, name: &str) -> Result<ReindexStats, EngineError> {
+        let start = Instant::now();
+        let key = self.table_name(name)?;
+        let table = self
+            .tables
+            .get_mut(&key)
+            .ok_or_else(|| EngineError::TableNotFound(name.to_string()))?;
+        let indexes = table.reindex();
+        Ok(ReindexStats {
+            indexes,
+            rows: table.rows.len(),
+            elapsed: start.elapsed(),
+        })
+    }
+
+    /// Returns the schema key of the table referred to as name.
+    fn table_name(&self, name: &str) -> Result<String, EngineError> {
+        if self.tables.contains_key(name) && !self.case_insensitive {
+            return Ok(name.to_string());
+        }
+        let keys: Vec<&String> = self.tables.keys().collect();
+        resolve_name(keys.iter().map(|k| k.as_str()), name, self.case_insensitive)?
+            .map(|pos| keys[pos].clone())
+            .ok_or_else(|| EngineError::TableNotFound(name.to_string()))
+    }
+
+    fn get_table(&self, name: &str) -> Result<&Table, EngineError> {
+        let key = self.table_name(name)?;
+        Ok(&self.tables[&key])
+    }
+
+    fn get_column_idx(&self, table: &Table, name: &str) -> Result<usize, EngineError> {
+        find_column(&table.columns, name, self.case_insensitive)
     }
 
     fn compare(a: &Value, op: &Operator, b: &Value) -> bool {
@@ -202,56 +534,294 @@ impl Engine {
         }
     }
 
-    pub fn select(&self, q: &SelectQuery) -> Result<Vec<Row>, EngineError> {
-        let table = self
-            .tables
-            .get(&q.table)
-            .ok_or_else(|| EngineError::TableNotFound(q.table.clone()))?;
-
-        let mut rows: Vec<Row> = if let Some(cond) = &q.condition {
-            let col_idx = Self::get_column_idx(table, &cond.column)?;
-            if let Operator::Eq = cond.op {
-                if let Some(index) = table.indices.get(&cond.column) {
-                    if let Some(row_indices) = index.get(&cond.value) {
-                        row_indices.iter().map(|&i| table.rows[i].clone()).collect()
-                    } else {
-                        Vec::new()
+    /// Returns the rows of table matching cond, in storage order, and
+    /// whether they were found through an index rather than a full scan.
+    fn filter<'a>(
+        &self,
+        table: &'a Table,
+        cond: &Condition,
+    ) -> Result<(Vec<&'a Row>, bool), EngineError> {
+        match cond {
+            Condition::Compare { column, op, value } => {
+                let col_idx = self.get_column_idx(table, column)?;
+                if let Operator::Eq = op {
+                    if let Some(index) = table.indices.get(&table.columns[col_idx].name) {
+                        // NULL rows are indexed too, but `= NULL` matches
+                        // nothing, as in the scan below.
+                        let found = match value {
+                            Value::Null => None,
+                            v => index.get(v),
+                        };
+                        let rows = match found {
+                            Some(row_indices) => {
+                                row_indices.iter().map(|&i| &table.rows[i]).collect()
+                            }
+                            None => Vec::new(),
+                        };
+                        return Ok((rows, true));
                     }
-                } else {
-                    table
-                        .rows
+                }
+                Ok((
+                    self.scan(&table.rows, |r| Self::compare(&r[col_idx], op, value)),
+                    false,
+                ))
+            }
+            Condition::Regex {
+                column,
+                pattern,
+                case_insensitive,
+            } => {
+                let col_idx = self.get_column_idx(table, column)?;
+                let re = self.regex(pattern, *case_insensitive)?;
+                Ok((
+                    self.scan(&table.rows, |r| match &r[col_idx] {
+                        Value::Text(s) => re.is_match(s),
+                        _ => false,
+                    }),
+                    false,
+                ))
+            }
+            Condition::In { column, values } => {
+                if values.len() > self.max_in_list {
+                    return Err(EngineError::InListTooLarge {
+                        limit: self.max_in_list,
+                        found: values.len(),
+                    });
+                }
+                let col_idx = self.get_column_idx(table, column)?;
+                // NULL never matches, even against a NULL in the list.
+                if let Some(index) = table.indices.get(&table.columns[col_idx].name) {
+                    let mut row_indices: Vec<usize> = values
                         .iter()
-                        .cloned()
-                        .filter(|r| Self::compare(&r[col_idx], &cond.op, &cond.value))
-                        .collect()
+                        .filter(|v| **v != Value::Null)
+                        .filter_map(|v| index.get(v))
+                        .flatten()
+                        .copied()
+                        .collect();
+                    row_indices.sort_unstable();
+                    row_indices.dedup();
+                    return Ok((row_indices.iter().map(|&i| &table.rows[i]).collect(), true));
                 }
-            } else {
-                table
-                    .rows
+                let rows = if values.len() > self.in_set_threshold {
+                    let set: HashSet<&Value> = values.iter().collect();
+                    self.scan(&table.rows, |r| {
+                        r[col_idx] != Value::Null && set.contains(&r[col_idx])
+                    })
+                } else {
+                    self.scan(&table.rows, |r| {
+                        values
+                            .iter()
+                            .any(|v| Self::compare(&r[col_idx], &Operator::Eq, v))
+                    })
+                };
+                Ok((rows, false))
+            }
+        }
+    }
+
+    /// Compiles pattern, reusing an earlier compilation of the same
+    /// pattern when possible.
+    fn regex(&self, pattern: &str, case_insensitive: bool) -> Result<Regex, EngineError> {
+        let key = (pattern.to_string(), case_insensitive);
+        let mut cache = self.regex_cache.lock().unwrap();
+        if let Some(re) = cache.get(&key) {
+            return Ok(re.clone());
+        }
+        let re = RegexBuilder::new(pattern)
+            .case_insensitive(case_insensitive)
+            .build()
+            .map_err(|e| EngineError::InvalidRegex {
+                pattern: pattern.to_string(),
+                message: e.to_string(),
+            })?;
+        if cache.len() >= REGEX_CACHE_SIZE {
+            cache.clear();
+        }
+        cache.insert(key, re.clone());
+        Ok(re)
+    }
+
+    /// Returns the rows matching pred in storage order. Large inputs are
+    /// split into contiguous chunks filtered on `scan_workers` threads and
+    /// concatenated in chunk order, so the result is identical to a
+    /// sequential scan.
+    fn scan<'a, F>(&self, rows: &'a [Row], pred: F) -> Vec<&'a Row>
+    where
+        F: Fn(&Row) -> bool + Sync,
+    {
+        let workers = self.scan_workers.max(1);
+        if workers == 1 || rows.len() < self.parallel_scan_threshold.max(workers) {
+            return rows.iter().filter(|r| pred(r)).collect();
+        }
+        let chunk = (rows.len() + workers - 1) / workers;
+        let pred = &pred;
+        std::thread::scope(|s| {
+            let handles: Vec<_> = rows
+                .chunks(chunk)
+                .map(|c| s.spawn(move || c.iter().filter(|r| pred(r)).collect::<Vec<_>>()))
+                .collect();
+            handles
+                .into_iter()
+                .flat_map(|h| h.join().expect("scan worker panicked"))
+                .collect()
+        })
+    }
+
+    /// Resolves every column reference in expr against table, so that an
+    /// unknown column is an error even when no row is evaluated and rows
+    /// are evaluated without looking names up again.
+    fn resolve<'q>(&self, table: &Table, expr: &'q Expr) -> Result<Resolved<'q>, EngineError> {
+        Ok(match expr {
+            Expr::Column(name) => Resolved::Column(self.get_column_idx(table, name)?),
+            Expr::Literal(v) => Resolved::Literal(v),
+            Expr::Function { name, args } => Resolved::Function {
+                name,
+                args: args
+                    .iter()
+                    .map(|a| self.resolve(table, a))
+                    .collect::<Result<_, _>>()?,
+            },
+            Expr::JsonGet { expr, key, as_text } => Resolved::JsonGet {
+                expr: Box::new(self.resolve(table, expr)?),
+                key,
+                as_text: *as_text,
+            },
+            Expr::Binary { op, left, right } => Resolved::Binary {
+                op: *op,
+                left: Box::new(self.resolve(table, left)?),
+                right: Box::new(self.resolve(table, right)?),
+            },
+        })
+    }
+
+    /// Evaluates a resolved expression against row.
+    fn eval(&self, expr: &Resolved, row: &Row) -> Result<Value, EngineError> {
+        match expr {
+            Resolved::Column(idx) => Ok(row[*idx].clone()),
+            Resolved::Literal(v) => Ok((*v).clone()),
+            Resolved::Function { name, args } => {
+                let args = args
                     .iter()
-                    .cloned()
-                    .filter(|r| Self::compare(&r[col_idx], &cond.op, &cond.value))
-                    .collect()
+                    .map(|a| self.eval(a, row))
+                    .collect::<Result<Vec<_>, _>>()?;
+                functions::call(name, args)
+            }
+            Resolved::JsonGet { expr, key, as_text } => {
+                let doc = self.eval(expr, row)?;
+                Ok(functions::json_get(&doc, key, *as_text))
             }
+            Resolved::Binary { op, left, right } => {
+                let l = self.eval(left, row)?;
+                let r = self.eval(right, row)?;
+                self.arithmetic(*op, &l, &r)
+            }
+        }
+    }
+
+    /// Applies op to two integers. NULL operands give NULL; division by
+    /// zero follows `Engine::division_by_zero`.
+    fn arithmetic(&self, op: ArithOp, l: &Value, r: &Value) -> Result<Value, EngineError> {
+        let invalid = |message: &str| EngineError::InvalidOperands {
+            op: op.symbol().to_string(),
+            message: message.to_string(),
+        };
+        let (a, b) = match (l, r) {
+            (Value::Null, _) | (_, Value::Null) => return Ok(Value::Null),
+            (Value::Int(a), Value::Int(b)) => (*a, *b),
+            _ => return Err(invalid("expected integer operands")),
+        };
+        if op == ArithOp::Div && b == 0 {
+            return match &self.division_by_zero {
+                DivisionByZero::Error => Err(EngineError::DivisionByZero),
+                DivisionByZero::Null => Ok(Value::Null),
+                DivisionByZero::Sentinel(v) => Ok(v.clone()),
+            };
+        }
+        let result = match op {
+            ArithOp::Add => a.checked_add(b),
+            ArithOp::Sub => a.checked_sub(b),
+            ArithOp::Mul => a.checked_mul(b),
+            ArithOp::Div => a.checked_div(b),
+        };
+        result
+            .map(Value::Int)
+            .ok_or_else(|| invalid("integer overflow"))
+    }
+
+    /// Orders two values for ORDER BY. NULLs are grouped at the start or
+    /// end according to the clause, independently of the sort direction.
+    fn order_values(a: &Value, b: &Value, order: &OrderBy) -> Ordering {
+        let ord = match (a, b) {
+            (Value::Null, Value::Null) => return Ordering::Equal,
+            (Value::Null, _) if order.nulls_first => return Ordering::Less,
+            (Value::Null, _) => return Ordering::Greater,
+            (_, Value::Null) if order.nulls_first => return Ordering::Greater,
+            (_, Value::Null) => return Ordering::Less,
+            (Value::Int(x), Value::Int(y)) => x.cmp(y),
+            (Value::Text(x), Value::Text(y)) => x.cmp(y),
+            (Value::Bool(x), Value::Bool(y)) => x.cmp(y),
+            _ => Ordering::Equal,
+        };
+        if order.asc {
+            ord
         } else {
-            table.rows.clone()
+            ord.reverse()
+        }
+    }
+
+    pub fn select(&self, q: &SelectQuery) -> Result<Vec<Row>, EngineError> {
+        self.select_with_stats(q).map(|(rows, _)| rows)
+    }
+
+    /// Runs q like `select` and also reports how many rows it read to
+    /// produce the result. A large gap between `rows_scanned` and
+    /// `rows_returned` without `index_used` suggests a missing index.
+    pub fn select_with_stats(&self, q: &SelectQuery) -> Result<(Vec<Row>, ScanStats), EngineError> {
+        let table = self.get_table(&q.table)?;
+        let columns = q
+            .columns
+            .iter()
+            .map(|e| self.resolve(table, e))
+            .collect::<Result<Vec<_>, _>>()?;
+        let order_key = match &q.order_by {
+            Some(order) => Some(self.resolve(table, &order.expr)?),
+            None => None,
         };
 
-        if let Some((ref col, asc)) = q.order_by {
-            let idx = Self::get_column_idx(table, col)?;
-            rows.sort_by(|a, b| {
-                let va = &a[idx];
-                let vb = &b[idx];
-                match (va, vb) {
-                    (Value::Int(x), Value::Int(y)) => x.cmp(y),
-                    (Value::Text(x), Value::Text(y)) => x.cmp(y),
-                    (Value::Bool(x), Value::Bool(y)) => x.cmp(y),
-                    _ => std::cmp::Ordering::Equal,
-                }
-            });
-            if !asc {
-                rows.reverse();
+        let (candidates, index_used): (Vec<&Row>, bool) = match &q.condition {
+            Some(cond) => self.filter(table, cond)?,
+            None => (table.rows.iter().collect(), false),
+        };
+        let rows_scanned = if index_used {
+            candidates.len()
+        } else {
+            table.rows.len()
+        };
+
+        let mut budget = MemoryBudget::new(self.memory_limit);
+        let mut rows = Vec::with_capacity(candidates.len());
+        for row in candidates {
+            budget.charge(row_bytes(row))?;
+            rows.push(row.clone());
+        }
+
+        if let (Some(order), Some(order_key)) = (&q.order_by, &order_key) {
+            // Sort keys are evaluated once per row, then the stable sort
+            // allocates a scratch buffer of up to half the input.
+            let mut keyed = Vec::with_capacity(rows.len());
+            for row in rows {
+                let key = self.eval(order_key, &row)?;
+                budget.charge(value_bytes(&key))?;
+                keyed.push((key, row));
             }
+            let cmp = |a: &(Value, Row), b: &(Value, Row)| Self::order_values(&a.0, &b.0, order);
+            if self.stable_sort {
+                budget.charge(keyed.len() / 2 * std::mem::size_of::<(Value, Row)>())?;
+                keyed.sort_by(cmp);
+            } else {
+                keyed.sort_unstable_by(cmp);
+            }
+            rows = keyed.into_iter().map(|(_, row)| row).collect();
         }
 
         let start = q.offset.unwrap_or(0);
@@ -266,25 +836,126 @@ impl Engine {
             }
         }
 
-        let result = if q.columns.is_empty() {
+        let result = if columns.is_empty() {
             rows
         } else {
-            let indices: Result<Vec<usize>, EngineError> = q
-                .columns
-                .iter()
-                .map(|c| Self::get_column_idx(table, c))
-                .collect();
-            let indices = indices?;
             rows.into_iter()
-                .map(|r| indices.iter().map(|&i| r[i].clone()).collect())
-                .collect()
+                .map(|r| {
+                    columns
+                        .iter()
+                        .map(|e| self.eval(e, &r))
+                        .collect::<Result<Row, _>>()
+                })
+                .collect::<Result<Vec<_>, _>>()?
+        };
+        let stats = ScanStats {
+            rows_scanned,
+            rows_returned: result.len(),
+            index_used,
+        };
+        Ok((result, stats))
+    }
+
+    /// Estimates the work a query will do, in rows touched, without running
+    /// it. A SELECT costs the rows it reads (the index matches for an
+    /// indexed `=` or `IN`, otherwise the whole table) plus n*log2(n) when it
+    /// sorts them; a set operation costs both operands. INSERT costs 1.
+    pub fn estimate_cost(&self, query: &Query) -> Result<usize, EngineError> {
+        match query {
+            Query::Select(q) => self.select_cost(q),
+            Query::Set(q) => Ok(self.select_cost(&q.left)? + self.select_cost(&q.right)?),
+            Query::Insert(_) => Ok(1),
+        }
+    }
+
+    fn select_cost(&self, q: &SelectQuery) -> Result<usize, EngineError> {
+        let table = self.get_table(&q.table)?;
+        let indexed = |column: &str| -> Result<_, EngineError> {
+            let idx = self.get_column_idx(table, column)?;
+            Ok(table.indices.get(&table.columns[idx].name))
         };
-        Ok(result)
+        let matches = |index: &HashMap<Value, Vec<usize>>, v: &Value| {
+            index.get(v).map_or(0, |rows| rows.len())
+        };
+        let read = match &q.condition {
+            Some(Condition::Compare {
+                column,
+                op: Operator::Eq,
+                value,
+            }) => indexed(column)?.map_or(table.rows.len(), |index| matches(index, value)),
+            Some(Condition::In { column, values }) => indexed(column)?
+                .map_or(table.rows.len(), |index| {
+                    values.iter().map(|v| matches(index, v)).sum()
+                }),
+            _ => table.rows.len(),
+        };
+        let sort = match &q.order_by {
+            Some(_) if read > 1 => read * (usize::BITS - (read - 1).leading_zeros()) as usize,
+            _ => 0,
+        };
+        Ok(read + sort)
+    }
+
+    fn check_cost(&self, query: &Query) -> Result<(), EngineError> {
+        if let Some(budget) = self.cost_budget {
+            let estimate = self.estimate_cost(query)?;
+            if estimate > budget {
+                return Err(EngineError::CostBudgetExceeded { budget, estimate });
+            }
+        }
+        Ok(())
+    }
+
+    /// Number of columns a SELECT produces.
+    fn output_width(&self, q: &SelectQuery) -> Result<usize, EngineError> {
+        if !q.columns.is_empty() {
+            return Ok(q.columns.len());
+        }
+        self.get_table(&q.table).map(|t| t.columns.len())
+    }
+
+    /// Runs an EXCEPT or INTERSECT. Rows keep the order of the left
+    /// operand.
+    pub fn set_operation(&self, q: &SetQuery) -> Result<Vec<Row>, EngineError> {
+        let (l, r) = (self.output_width(&q.left)?, self.output_width(&q.right)?);
+        if l != r {
+            return Err(EngineError::ColumnCountMismatch { left: l, right: r });
+        }
+        let left = self.select(&q.left)?;
+        let right = self.select(&q.right)?;
+
+        let mut counts: HashMap<Row, usize> = HashMap::new();
+        for row in right {
+            *counts.entry(row).or_default() += 1;
+        }
+        let mut seen: HashSet<Row> = HashSet::new();
+        let mut out = Vec::new();
+        for row in left {
+            let in_right = match counts.get_mut(&row) {
+                Some(n) if *n > 0 => {
+                    if q.all {
+                        *n -= 1;
+                    }
+                    true
+                }
+                _ => false,
+            };
+            let keep = match q.op {
+                SetOperator::Except => !in_right,
+                SetOperator::Intersect => in_right,
+            };
+            if keep && (q.all || seen.insert(row.clone())) {
+                out.push(row);
+            }
+        }
+        Ok(out)
     }
 
     pub fn execute(&mut self, query: crate::parser::Query) -> Result<Vec<Row>, EngineError> {
+        self.check_cost(&query)?;
         match query {
             crate::parser::Query::Select(q) => self.select(&q),
+            crate::parser::Query::Set(q) => self.set_operation(&q),
             crate::parser::Query::Insert(q) => {
                 self.insert_into(&q.table, q.values, q.columns)?;
                 Ok(Vec::new())
@@ -0,0 +1,285 @@
+//! Scalar functions available in expressions.
+
+use crate::engine::{EngineError, Value};
+
+/// Calls the function `name` (upper-cased) with already evaluated
+/// arguments.
+pub fn call(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    match name {
+        "COALESCE" => coalesce(args),
+        "CONCAT_WS" => concat_ws(name, args),
+        "INSTR" | "STRPOS" => instr(name, args),
+        "IFNULL" | "ISNULL" => {
+            expect_args(name, &args, 2)?;
+            coalesce(args)
+        }
+        "LENGTH" => length(name, args),
+        "LPAD" => pad(name, args, true),
+        "POWER" | "POW" => power(name, args),
+        "RPAD" => pad(name, args, false),
+        "SAFE_DIVIDE" => safe_divide(name, args),
+        "SIGN" => sign(name, args),
+        "TO_CHAR" => to_char(name, args),
+        _ => Err(EngineError::UnknownFunction(name.to_string())),
+    }
+}
+
+fn invalid(function: &str, message: &str) -> EngineError {
+    EngineError::InvalidArgument {
+        function: function.to_string(),
+        message: message.to_string(),
+    }
+}
+
+fn expect_args(function: &str, args: &[Value], n: usize) -> Result<(), EngineError> {
+    if args.len() != n {
+        return Err(invalid(function, &format!("expected {} argument(s)", n)));
+    }
+    Ok(())
+}
+
+/// COALESCE(a, b, ...): the first non-NULL argument, or NULL. IFNULL(a, b)
+/// (MySQL) and ISNULL(a, b) (SQL Server) are its two-argument forms.
+fn coalesce(args: Vec<Value>) -> Result<Value, EngineError> {
+    Ok(args
+        .into_iter()
+        .find(|v| *v != Value::Null)
+        .unwrap_or(Value::Null))
+}
+
+/// CONCAT_WS(sep, a, b, ...): joins the non-NULL arguments with sep, so
+/// all-NULL arguments give an empty string. Integers and booleans are
+/// rendered as text. A NULL separator gives NULL.
+fn concat_ws(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    let mut args = args.into_iter();
+    let sep = match args.next() {
+        Some(Value::Text(sep)) => sep,
+        Some(Value::Null) => return Ok(Value::Null),
+        Some(_) => return Err(invalid(name, "expected a text separator")),
+        None => return Err(invalid(name, "expected at least 1 argument(s)")),
+    };
+    let parts: Vec<String> = args
+        .filter_map(|v| match v {
+            Value::Text(s) => Some(s),
+            Value::Int(n) => Some(n.to_string()),
+            Value::Bool(b) => Some(b.to_string()),
+            Value::Null => None,
+        })
+        .collect();
+    Ok(Value::Text(parts.join(&sep)))
+}
+
+/// INSTR(haystack, needle) / STRPOS(haystack, needle): 1-based character
+/// position of the first occurrence of needle, or 0 if it does not occur.
+/// An empty needle is found at position 1, as in MySQL and PostgreSQL.
+/// NULL inputs give NULL.
+fn instr(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    expect_args(name, &args, 2)?;
+    match (&args[0], &args[1]) {
+        (Value::Null, _) | (_, Value::Null) => Ok(Value::Null),
+        (Value::Text(haystack), Value::Text(needle)) => Ok(Value::Int(
+            haystack
+                .find(needle.as_str())
+                .map_or(0, |byte| haystack[..byte].chars().count() as i64 + 1),
+        )),
+        _ => Err(invalid(name, "expected text arguments")),
+    }
+}
+
+/// LENGTH(s): number of characters (not bytes) in s.
+fn length(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    expect_args(name, &args, 1)?;
+    match &args[0] {
+        Value::Text(s) => Ok(Value::Int(s.chars().count() as i64)),
+        Value::Null => Ok(Value::Null),
+        _ => Err(invalid(name, "expected a text argument")),
+    }
+}
+
+/// SAFE_DIVIDE(a, b): integer division that yields NULL instead of failing
+/// when b is zero, as in BigQuery. NULL inputs give NULL.
+fn safe_divide(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    expect_args(name, &args, 2)?;
+    match (&args[0], &args[1]) {
+        (Value::Null, _) | (_, Value::Null) | (_, Value::Int(0)) => Ok(Value::Null),
+        (Value::Int(a), Value::Int(b)) => a
+            .checked_div(*b)
+            .map(Value::Int)
+            .ok_or_else(|| invalid(name, "integer overflow")),
+        _ => Err(invalid(name, "expected integer arguments")),
+    }
+}
+
+/// SIGN(x): -1, 0 or 1 according to the sign of integer x. NULL gives
+/// NULL.
+fn sign(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    expect_args(name, &args, 1)?;
+    match &args[0] {
+        Value::Int(n) => Ok(Value::Int(n.signum())),
+        Value::Null => Ok(Value::Null),
+        _ => Err(invalid(name, "expected an integer argument")),
+    }
+}
+
+/// POWER(base, exp) / POW(base, exp): base raised to exp. Values are
+/// integers, so exp must be non-negative: a negative exponent would need
+/// a fractional result and is an error, as is overflow. POWER(0, 0) is 1,
+/// as in PostgreSQL and MySQL. NULL inputs give NULL.
+fn power(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    expect_args(name, &args, 2)?;
+    let (base, exp) = match (&args[0], &args[1]) {
+        (Value::Null, _) | (_, Value::Null) => return Ok(Value::Null),
+        (Value::Int(base), Value::Int(exp)) => (*base, *exp),
+        _ => return Err(invalid(name, "expected integer arguments")),
+    };
+    let exp = u32::try_from(exp).map_err(|_| {
+        if exp < 0 {
+            invalid(name, "negative exponent")
+        } else {
+            invalid(name, "integer overflow")
+        }
+    })?;
+    base.checked_pow(exp)
+        .map(Value::Int)
+        .ok_or_else(|| invalid(name, "integer overflow"))
+}
+
+/// Longest result LPAD and RPAD will build, in characters. A larger len
+/// is rejected rather than allocated.
+const MAX_PAD_LENGTH: i64 = 1 << 20;
+
+/// LPAD(s, len, pad) / RPAD(s, len, pad): pads s to len characters by
+/// repeating pad on the left or right. As in PostgreSQL, a string already
+/// longer than len is truncated to its first len characters, and an empty
+/// pad leaves a short string unchanged. NULL inputs give NULL.
+fn pad(name: &str, args: Vec<Value>, left: bool) -> Result<Value, EngineError> {
+    expect_args(name, &args, 3)?;
+    let (s, len, fill) = match (&args[0], &args[1], &args[2]) {
+        (Value::Null, _, _) | (_, Value::Null, _) | (_, _, Value::Null) => return Ok(Value::Null),
+        (Value::Text(s), Value::Int(len), Value::Text(fill)) => (s, *len, fill),
+        _ => return Err(invalid(name, "expected (text, integer, text) arguments")),
+    };
+    if len > MAX_PAD_LENGTH {
+        return Err(invalid(
+            name,
+            &format!("length {len} exceeds the maximum of {MAX_PAD_LENGTH}"),
+        ));
+    }
+    let len = len.max(0) as usize;
+    let chars = s.chars().count();
+    if chars >= len {
+        return Ok(Value::Text(s.chars().take(len).collect()));
+    }
+    if fill.is_empty() {
+        return Ok(Value::Text(s.clone()));
+    }
+    let padding: String = fill.chars().cycle().take(len - chars).collect();
+    Ok(Value::Text(if left {
+        padding + s
+    } else {
+        s.clone() + &padding
+    }))
+}
+
+/// Implements `doc -> key` and `doc ->> key`. doc is JSON text; a text key
+/// selects an object field and an integer key an array element. `->`
+/// yields the element re-encoded as JSON, `->>` yields strings unquoted
+/// and other elements as JSON text. NULL input, invalid JSON and missing
+/// paths give NULL, as does a JSON null under `->>`.
+pub fn json_get(doc: &Value, key: &Value, as_text: bool) -> Value {
+    let Value::Text(doc) = doc else {
+        return Value::Null;
+    };
+    let Ok(doc) = serde_json::from_str::<serde_json::Value>(doc) else {
+        return Value::Null;
+    };
+    let elem = match key {
+        Value::Text(k) => doc.get(k.as_str()),
+        Value::Int(n) => usize::try_from(*n).ok().and_then(|n| doc.get(n)),
+        _ => None,
+    };
+    match elem {
+        None => Value::Null,
+        Some(serde_json::Value::Null) if as_text => Value::Null,
+        Some(serde_json::Value::String(s)) if as_text => Value::Text(s.clone()),
+        Some(v) => Value::Text(v.to_string()),
+    }
+}
+
+/// TO_CHAR(n, pattern): formats integer n using a PostgreSQL-style numeric
+/// pattern. `9` is a digit position shown as a space when it would be a
+/// leading zero, `0` is a digit position that forces zeros from there
+/// rightwards, `,` is a group separator shown only after a digit, and `.`
+/// starts the fraction, whose positions print as `0`. Output has the
+/// width of the pattern plus one column for the sign, which is `-` for
+/// negatives and a space otherwise. A leading `FM` drops the padding, the
+/// blank sign and trailing `9` fraction positions. A number with more
+/// digits than there are positions prints `#` in each. NULL inputs give
+/// NULL.
+fn to_char(name: &str, args: Vec<Value>) -> Result<Value, EngineError> {
+    expect_args(name, &args, 2)?;
+    let (n, pattern) = match (&args[0], &args[1]) {
+        (Value::Null, _) | (_, Value::Null) => return Ok(Value::Null),
+        (Value::Int(n), Value::Text(pattern)) => (*n, pattern.as_str()),
+        _ => return Err(invalid(name, "expected (integer, text) arguments")),
+    };
+    let (fill_mode, pattern) = match pattern.get(..2) {
+        Some(prefix) if prefix.eq_ignore_ascii_case("FM") => (true, &pattern[2..]),
+        _ => (false, pattern),
+    };
+    let (int_pat, frac_pat) = pattern.split_once('.').unwrap_or((pattern, ""));
+    let slots = int_pat.chars().filter(|c| matches!(c, '9' | '0')).count();
+    if slots == 0
+        || int_pat.chars().any(|c| !matches!(c, '9' | '0' | ','))
+        || frac_pat.chars().any(|c| !matches!(c, '9' | '0'))
+    {
+        return Err(invalid(name, &format!("unsupported pattern {:?}", pattern)));
+    }
+
+    let digits: Vec<char> = n.unsigned_abs().to_string().chars().collect();
+    let overflow = digits.len() > slots;
+    let first_zero = int_pat.find('0').unwrap_or(int_pat.len());
+    let mut remaining = digits.len();
+    let mut cells: Vec<Option<char>> = vec![None; int_pat.len()];
+    for (pos, c) in int_pat.char_indices().rev() {
+        cells[pos] = match c {
+            ',' => Some(','),
+            _ if overflow => Some('#'),
+            _ if remaining > 0 => {
+                remaining -= 1;
+                Some(digits[remaining])
+            }
+            _ if pos >= first_zero => Some('0'),
+            _ => None,
+        };
+    }
+    let mut seen_digit = false;
+    for cell in cells.iter_mut() {
+        match cell {
+            Some(',') if !seen_digit => *cell = None,
+            Some(_) => seen_digit = true,
+            None => {}
+        }
+    }
+
+    let mut out = String::new();
+    if !fill_mode {
+        out.extend(cells.iter().filter(|c| c.is_none()).map(|_| ' '));
+    }
+    if n < 0 {
+        out.push('-');
+    } else if !fill_mode {
+        out.push(' ');
+    }
+    out.extend(cells.iter().flatten());
+    if pattern.contains('.') {
+        out.push('.');
+        let kept = if fill_mode {
+            frac_pat.trim_end_matches('9')
+        } else {
+            frac_pat
+        };
+        out.extend(kept.chars().map(|_| if overflow { '#' } else { '0' }));
+    }
+    Ok(Value::Text(out))
+}
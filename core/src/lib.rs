@@ -1,7 +1,14 @@
 pub mod engine;
+mod functions;
 pub mod parser;
 
-pub use engine::{Engine, EngineError, Row, Table, Value, ValueType};
+pub use engine::{
+    DivisionByZero, Engine, EngineError, OmittedColumns, ReindexStats, Row, ScanStats, Table,
+    Value, ValueType, DEFAULT_IN_SET_THRESHOLD, DEFAULT_MAX_IN_LIST,
+    DEFAULT_PARALLEL_SCAN_THRESHOLD,
+};
 pub use parser::{
-    parse_insert, parse_query, parse_select, Condition, InsertQuery, Operator, Query, SelectQuery,
+    parse_expr, parse_insert, parse_query, parse_query_limited, parse_query_within, parse_select,
+    ArithOp, Condition, Expr, InsertQuery, Operator, OrderBy, ParseError, Query, SelectQuery,
+    SetOperator, SetQuery, DEFAULT_MAX_NESTING, DEFAULT_PARSE_BUDGET,
 };
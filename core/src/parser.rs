@@ -2,12 +2,15 @@ use nom::{
     branch::alt,
     bytes::complete::{tag, tag_no_case, take_while1},
     character::complete::{char, digit1, multispace0, multispace1},
-    combinator::{map, map_res, opt},
-    multi::{separated_list0, separated_list1},
-    sequence::{delimited, preceded, separated_pair, tuple},
+    combinator::{map, map_res, not, opt, recognize, value},
+    multi::{many0, separated_list0, separated_list1},
+    sequence::{delimited, pair, preceded, separated_pair, terminated, tuple},
     IResult,
 };
 
+use std::cell::Cell;
+use std::time::{Duration, Instant};
+
 use crate::engine::Value;
 
 #[derive(Debug, PartialEq)]
@@ -21,18 +24,86 @@ pub enum Operator {
 }
 
 #[derive(Debug, PartialEq)]
-pub struct Condition {
-    pub column: String,
-    pub op: Operator,
-    pub value: Value,
+pub enum Condition {
+    /// `column <op> value`
+    Compare {
+        column: String,
+        op: Operator,
+        value: Value,
+    },
+    /// `column IN (v1, v2, ...)`
+    In { column: String, values: Vec<Value> },
+    /// `column REGEXP 'pattern'` or `column ~ 'pattern'`; `~*` matches
+    /// ignoring case.
+    Regex {
+        column: String,
+        pattern: String,
+        case_insensitive: bool,
+    },
+}
+
+/// Scalar expression evaluated per row.
+#[derive(Debug, PartialEq)]
+pub enum Expr {
+    Column(String),
+    Literal(Value),
+    /// Function call. The name is stored upper-cased.
+    Function {
+        name: String,
+        args: Vec<Expr>,
+    },
+    /// JSON field or array element access: `expr -> key` yields JSON text,
+    /// `expr ->> key` the element as plain text.
+    JsonGet {
+        expr: Box<Expr>,
+        key: Value,
+        as_text: bool,
+    },
+    /// Integer arithmetic on two operands.
+    Binary {
+        op: ArithOp,
+        left: Box<Expr>,
+        right: Box<Expr>,
+    },
+}
+
+/// Arithmetic operator. `*` and `/` bind tighter than `+` and `-`; all are
+/// left-associative.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum ArithOp {
+    Add,
+    Sub,
+    Mul,
+    Div,
+}
+
+impl ArithOp {
+    pub fn symbol(self) -> &'static str {
+        match self {
+            ArithOp::Add => "+",
+            ArithOp::Sub => "-",
+            ArithOp::Mul => "*",
+            ArithOp::Div => "/",
+        }
+    }
+}
+
+/// ORDER BY clause. When no NULLS FIRST/LAST modifier is given, NULLs sort
+/// as if larger than any value: last for ASC, first for DESC.
+#[derive(Debug, PartialEq)]
+pub struct OrderBy {
+    pub expr: Expr,
+    pub asc: bool,
+    pub nulls_first: bool,
 }
 
 #[derive(Debug, PartialEq)]
 pub struct SelectQuery {
     pub table: String,
-    pub columns: Vec<String>,
+    /// Output expressions; empty means `*`.
+    pub columns: Vec<Expr>,
     pub condition: Option<Condition>,
-    pub order_by: Option<(String, bool)>,
+    pub order_by: Option<OrderBy>,
     pub limit: Option<usize>,
     pub offset: Option<usize>,
 }
@@ -44,10 +115,28 @@ pub struct InsertQuery {
     pub values: Vec<Value>,
 }
 
+#[derive(Debug, PartialEq)]
+pub enum SetOperator {
+    Except,
+    Intersect,
+}
+
+/// `left EXCEPT|INTERSECT [ALL] right`. Without ALL the result is
+/// deduplicated; with ALL duplicates are kept according to multiset
+/// semantics. ORDER BY and LIMIT bind to the operand they follow.
+#[derive(Debug, PartialEq)]
+pub struct SetQuery {
+    pub left: SelectQuery,
+    pub op: SetOperator,
+    pub all: bool,
+    pub right: SelectQuery,
+}
+
 #[derive(Debug, PartialEq)]
 pub enum Query {
     Select(SelectQuery),
     Insert(InsertQuery),
+    Set(SetQuery),
 }
 
 fn identifier(i: &str) -> IResult<&str, &str> {
@@ -65,17 +154,31 @@ fn parse_operator(i: &str) -> IResult<&str, Operator> {
     ))(i)
 }
 
+/// Parses a single-quoted string. A doubled quote inside it stands for
+/// one literal quote, as in standard SQL: `'it''s'` is `it's`.
+fn parse_string_literal(i: &str) -> IResult<&str, String> {
+    map(
+        delimited(
+            char('\''),
+            many0(alt((value("'", tag("''")), take_while1(|c| c != '\'')))),
+            char('\''),
+        ),
+        |parts| parts.concat(),
+    )(i)
+}
+
 fn parse_value(i: &str) -> IResult<&str, Value> {
-    let parse_int = map_res(digit1, |s: &str| s.parse::<i64>().map(Value::Int));
-    let parse_string = map(
-        delimited(char('\''), take_while1(|c| c != '\''), char('\'')),
-        |s: &str| Value::Text(s.to_string()),
-    );
-    let parse_bool = alt((
+    let (i, _) = check_deadline(i)?;
+    let parse_int = map_res(recognize(pair(opt(char('-')), digit1)), |s: &str| {
+        s.parse::<i64>().map(Value::Int)
+    });
+    let parse_string = map(parse_string_literal, Value::Text);
+    let parse_keyword = alt((
         map(tag_no_case("TRUE"), |_| Value::Bool(true)),
         map(tag_no_case("FALSE"), |_| Value::Bool(false)),
+        map(tag_no_case("NULL"), |_| Value::Null),
     ));
-    alt((parse_int, parse_string, parse_bool))(i)
+    alt((parse_int, parse_string, parse_keyword))(i)
 }
 
 fn parse_values(i: &str) -> IResult<&str, Vec<Value>> {
@@ -101,40 +204,210 @@ fn parse_column_names(i: &str) -> IResult<&str, Vec<String>> {
     .map(|(i, cols)| (i, cols.into_iter().map(|s| s.to_string()).collect()))
 }
 
-fn parse_condition(i: &str) -> IResult<&str, Condition> {
-    map(
-        tuple((
-            identifier,
-            preceded(multispace0, parse_operator),
+fn parse_in_list(i: &str) -> IResult<&str, Condition> {
+    let (i, col) = identifier(i)?;
+    let (i, _) = tuple((multispace1, tag_no_case("IN"), multispace0))(i)?;
+    let (i, values) = delimited(
+        char('('),
+        separated_list1(
+            preceded(multispace0, char(',')),
             preceded(multispace0, parse_value),
+        ),
+        preceded(multispace0, char(')')),
+    )(i)?;
+    Ok((
+        i,
+        Condition::In {
+            column: col.to_string(),
+            values,
+        },
+    ))
+}
+
+fn parse_regex_match(i: &str) -> IResult<&str, Condition> {
+    let (i, col) = identifier(i)?;
+    let (i, case_insensitive) = preceded(
+        multispace0,
+        alt((
+            value(true, tag("~*")),
+            value(false, tag("~")),
+            value(false, tag_no_case("REGEXP")),
         )),
-        |(col, op, val)| Condition {
+    )(i)?;
+    let (i, pattern) = preceded(multispace0, parse_string_literal)(i)?;
+    Ok((
+        i,
+        Condition::Regex {
             column: col.to_string(),
-            op,
-            value: val,
+            pattern,
+            case_insensitive,
         },
+    ))
+}
+
+fn parse_condition(i: &str) -> IResult<&str, Condition> {
+    alt((
+        parse_in_list,
+        parse_regex_match,
+        map(
+            tuple((
+                identifier,
+                preceded(multispace0, parse_operator),
+                preceded(multispace0, parse_value),
+            )),
+            |(col, op, val)| Condition::Compare {
+                column: col.to_string(),
+                op,
+                value: val,
+            },
+        ),
+    ))(i)
+}
+
+/// Parses an output expression with an optional `AS name`. Result rows
+/// carry no column names, so the alias is accepted and discarded.
+fn parse_output_column(i: &str) -> IResult<&str, Expr> {
+    terminated(
+        parse_expr,
+        opt(tuple((
+            multispace1,
+            tag_no_case("AS"),
+            multispace1,
+            identifier,
+        ))),
     )(i)
 }
 
-fn parse_columns(i: &str) -> IResult<&str, Vec<String>> {
+fn parse_columns(i: &str) -> IResult<&str, Vec<Expr>> {
     alt((
         map(tag("*"), |_| Vec::new()),
-        map(
-            separated_list1(
-                preceded(multispace0, char(',')),
-                preceded(multispace0, identifier),
-            ),
-            |cols: Vec<&str>| cols.into_iter().map(|s| s.to_string()).collect(),
+        separated_list1(
+            preceded(multispace0, char(',')),
+            preceded(multispace0, parse_output_column),
         ),
     ))(i)
 }
 
-fn parse_order_by(i: &str) -> IResult<&str, (String, bool)> {
+fn parse_function(i: &str) -> IResult<&str, Expr> {
+    let (i, name) = identifier(i)?;
+    let (i, _) = multispace0(i)?;
+    let (i, args) = delimited(
+        char('('),
+        separated_list0(
+            preceded(multispace0, char(',')),
+            preceded(multispace0, parse_expr),
+        ),
+        preceded(multispace0, char(')')),
+    )(i)?;
+    Ok((
+        i,
+        Expr::Function {
+            name: name.to_ascii_uppercase(),
+            args,
+        },
+    ))
+}
+
+fn fold_binary(first: Expr, rest: Vec<(ArithOp, Expr)>) -> Expr {
+    rest.into_iter()
+        .fold(first, |left, (op, right)| Expr::Binary {
+            op,
+            left: Box::new(left),
+            right: Box::new(right),
+        })
+}
+
+pub fn parse_expr(i: &str) -> IResult<&str, Expr> {
+    let (i, first) = parse_term(i)?;
+    let (i, rest) = many0(pair(
+        preceded(
+            multispace0,
+            alt((
+                value(ArithOp::Add, char('+')),
+                value(ArithOp::Sub, char('-')),
+            )),
+        ),
+        preceded(multispace0, parse_term),
+    ))(i)?;
+    Ok((i, fold_binary(first, rest)))
+}
+
+fn parse_term(i: &str) -> IResult<&str, Expr> {
+    let (i, first) = parse_json_get(i)?;
+    let (i, rest) = many0(pair(
+        preceded(
+            multispace0,
+            alt((
+                value(ArithOp::Mul, char('*')),
+                value(ArithOp::Div, char('/')),
+            )),
+        ),
+        preceded(multispace0, parse_json_get),
+    ))(i)?;
+    Ok((i, fold_binary(first, rest)))
+}
+
+fn parse_json_get(i: &str) -> IResult<&str, Expr> {
+    let (i, first) = parse_atom(i)?;
+    let (i, path) = many0(pair(
+        preceded(
+            multispace0,
+            alt((value(true, tag("->>")), value(false, tag("->")))),
+        ),
+        preceded(multispace0, parse_value),
+    ))(i)?;
+    let expr = path
+        .into_iter()
+        .fold(first, |expr, (as_text, key)| Expr::JsonGet {
+            expr: Box::new(expr),
+            key,
+            as_text,
+        });
+    Ok((i, expr))
+}
+
+fn parse_atom(i: &str) -> IResult<&str, Expr> {
+    let (i, _) = check_deadline(i)?;
+    // Parentheses and function arguments recurse back into parse_atom, so
+    // its depth bounds the parser's stack use.
+    let depth = NESTING.with(|n| {
+        let depth = n.get() + 1;
+        n.set(depth);
+        depth
+    });
+    let result = if depth > MAX_NESTING.with(|m| m.get()) {
+        Err(nom::Err::Failure(nom::error::Error::new(
+            i,
+            nom::error::ErrorKind::Verify,
+        )))
+    } else {
+        parse_atom_inner(i)
+    };
+    NESTING.with(|n| n.set(depth - 1));
+    result
+}
+
+fn parse_atom_inner(i: &str) -> IResult<&str, Expr> {
+    alt((
+        delimited(
+            pair(char('('), multispace0),
+            parse_expr,
+            pair(multispace0, char(')')),
+        ),
+        parse_function,
+        // A literal must not run into an identifier, so `trueish` stays a
+        // column name rather than TRUE followed by garbage.
+        map(terminated(parse_value, not(identifier)), Expr::Literal),
+        map(identifier, |c: &str| Expr::Column(c.to_string())),
+    ))(i)
+}
+
+fn parse_order_by(i: &str) -> IResult<&str, OrderBy> {
     let (i, _) = tag("ORDER")(i)?;
     let (i, _) = multispace1(i)?;
     let (i, _) = tag("BY")(i)?;
     let (i, _) = multispace1(i)?;
-    let (i, col) = identifier(i)?;
+    let (i, expr) = parse_expr(i)?;
     let (i, dir) = opt(preceded(
         multispace1,
         alt((tag_no_case("ASC"), tag_no_case("DESC"))),
@@ -143,7 +416,22 @@ fn parse_order_by(i: &str) -> IResult<&str, (String, bool)> {
         Some(d) => d.eq_ignore_ascii_case("ASC"),
         None => true,
     };
-    Ok((i, (col.to_string(), asc)))
+    let (i, nulls) = opt(preceded(
+        tuple((multispace1, tag_no_case("NULLS"), multispace1)),
+        alt((tag_no_case("FIRST"), tag_no_case("LAST"))),
+    ))(i)?;
+    let nulls_first = match nulls {
+        Some(n) => n.eq_ignore_ascii_case("FIRST"),
+        None => !asc,
+    };
+    Ok((
+        i,
+        OrderBy {
+            expr,
+            asc,
+            nulls_first,
+        },
+    ))
 }
 
 fn parse_usize(i: &str) -> IResult<&str, usize> {
@@ -203,10 +491,112 @@ pub fn parse_insert(i: &str) -> IResult<&str, InsertQuery> {
     ))
 }
 
+fn parse_select_or_set(i: &str) -> IResult<&str, Query> {
+    let (i, left) = parse_select(i)?;
+    let (i, set) = opt(tuple((
+        preceded(
+            multispace0,
+            alt((
+                map(tag_no_case("EXCEPT"), |_| SetOperator::Except),
+                map(tag_no_case("INTERSECT"), |_| SetOperator::Intersect),
+            )),
+        ),
+        opt(preceded(multispace1, tag_no_case("ALL"))),
+        preceded(multispace1, parse_select),
+    )))(i)?;
+    let query = match set {
+        Some((op, all, right)) => Query::Set(SetQuery {
+            left,
+            op,
+            all: all.is_some(),
+            right,
+        }),
+        None => Query::Select(left),
+    };
+    Ok((i, query))
+}
+
+thread_local! {
+    /// Deadline of the `parse_query_within` call running on this thread.
+    static PARSE_DEADLINE: Cell<Option<Instant>> = const { Cell::new(None) };
+    /// Current and maximum expression nesting depth on this thread.
+    static NESTING: Cell<usize> = const { Cell::new(0) };
+    static MAX_NESTING: Cell<usize> = const { Cell::new(DEFAULT_MAX_NESTING) };
+}
+
+/// Deepest nesting of parentheses and function calls accepted in an
+/// expression by default. There are no subqueries, so this is the only
+/// recursion in the grammar; the limit keeps adversarial input from
+/// exhausting the stack. Exceeding it fails the parse with
+/// `ErrorKind::Verify`, which the parser uses for nothing else.
+pub const DEFAULT_MAX_NESTING: usize = 256;
+
+/// Fails, without backtracking, once the parse deadline has passed. It is
+/// checked for every expression atom and literal, which bounds the work
+/// between checks.
+fn check_deadline(i: &str) -> IResult<&str, ()> {
+    match PARSE_DEADLINE.with(|d| d.get()) {
+        Some(deadline) if Instant::now() >= deadline => Err(nom::Err::Failure(
+            nom::error::Error::new(i, nom::error::ErrorKind::TooLarge),
+        )),
+        _ => Ok((i, ())),
+    }
+}
+
+/// Why `parse_query_within` failed.
+#[derive(Debug, PartialEq)]
+pub enum ParseError {
+    /// Parsing ran past its time budget.
+    Timeout,
+    /// Expressions nest deeper than the allowed limit.
+    TooDeep { limit: usize },
+    /// The input is not a valid query.
+    Invalid(String),
+}
+
+/// Default budget for `parse_query_within`. It is deliberately generous:
+/// ordinary statements parse in microseconds, so only pathological input
+/// gets near it.
+pub const DEFAULT_PARSE_BUDGET: Duration = Duration::from_secs(1);
+
+/// Parses a query like `parse_query`, giving up with
+/// `ParseError::Timeout` if parsing takes longer than budget. Unlike
+/// `parse_query`, input left after the statement is an error.
+pub fn parse_query_within(i: &str, budget: Duration) -> Result<Query, ParseError> {
+    parse_query_limited(i, budget, DEFAULT_MAX_NESTING)
+}
+
+/// Parses a query like `parse_query_within`, also failing with
+/// `ParseError::TooDeep` when expressions nest deeper than max_nesting.
+pub fn parse_query_limited(
+    i: &str,
+    budget: Duration,
+    max_nesting: usize,
+) -> Result<Query, ParseError> {
+    let prev = PARSE_DEADLINE.with(|d| d.replace(Some(Instant::now() + budget)));
+    let prev_nesting = MAX_NESTING.with(|m| m.replace(max_nesting));
+    let result = parse_query(i);
+    PARSE_DEADLINE.with(|d| d.set(prev));
+    MAX_NESTING.with(|m| m.set(prev_nesting));
+    match result {
+        Ok(("", q)) => Ok(q),
+        Ok((rest, _)) => Err(ParseError::Invalid(format!("unexpected input: {}", rest))),
+        Err(nom::Err::Failure(e)) if e.code == nom::error::ErrorKind::TooLarge => {
+            Err(ParseError::Timeout)
+        }
+        Err(nom::Err::Failure(e)) if e.code == nom::error::ErrorKind::Verify => {
+            Err(ParseError::TooDeep { limit: max_nesting })
+        }
+        Err(e) => Err(ParseError::Invalid(e.to_string())),
+    }
+}
+
+/// Parses a single statement. One trailing `;`, with whitespace on either
+/// side, is consumed as part of it; anything after that is left unparsed.
 pub fn parse_query(i: &str) -> IResult<&str, Query> {
     let (i, _) = multispace0(i)?;
-    alt((
-        map(parse_select, Query::Select),
-        map(parse_insert, Query::Insert),
-    ))(i)
+    let (i, query) = alt((parse_select_or_set, map(parse_insert, Query::Insert)))(i)?;
+    let (i, _) = opt(pair(multispace0, char(';')))(i)?;
+    let (i, _) = multispace0(i)?;
+    Ok((i, query))
 }
@@ -1,4 +1,7 @@
-use sql_core::{parse_query, Engine, Value, ValueType};
+use sql_core::{
+    parse_query, parse_query_within, Engine, EngineError, OmittedColumns, Query, Row, ScanStats,
+    Value, ValueType,
+};
 
 #[test]
 fn basic_flow() {
@@ -96,3 +99,1242 @@ fn insert_with_columns() {
     assert_eq!(rows.len(), 1);
     assert_eq!(rows[0], vec![Value::Int(1), Value::Null, Value::Bool(true)]);
 }
+
+fn nullable_scores() -> Engine {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "scores",
+        vec![
+            ("name".into(), ValueType::Text),
+            ("score".into(), ValueType::Int),
+        ],
+    );
+    for sql in [
+        "INSERT INTO scores VALUES ('a', 2)",
+        "INSERT INTO scores (name) VALUES ('b')",
+        "INSERT INTO scores VALUES ('c', 1)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+    engine
+}
+
+fn names(engine: &mut Engine, sql: &str) -> Vec<Value> {
+    let rows = engine.execute(parse_query(sql).unwrap().1).unwrap();
+    rows.into_iter().map(|r| r[0].clone()).collect()
+}
+
+#[test]
+fn order_by_nulls() {
+    let mut engine = nullable_scores();
+    let text = |s: &str| Value::Text(s.into());
+
+    let cases = [
+        (
+            "SELECT name FROM scores ORDER BY score ASC",
+            ["c", "a", "b"],
+        ),
+        (
+            "SELECT name FROM scores ORDER BY score DESC",
+            ["b", "a", "c"],
+        ),
+        (
+            "SELECT name FROM scores ORDER BY score ASC NULLS FIRST",
+            ["b", "c", "a"],
+        ),
+        (
+            "SELECT name FROM scores ORDER BY score ASC NULLS LAST",
+            ["c", "a", "b"],
+        ),
+        (
+            "SELECT name FROM scores ORDER BY score DESC NULLS FIRST",
+            ["b", "a", "c"],
+        ),
+        (
+            "SELECT name FROM scores ORDER BY score DESC NULLS LAST",
+            ["a", "c", "b"],
+        ),
+    ];
+    for (sql, want) in cases {
+        let want: Vec<Value> = want.iter().map(|s| text(s)).collect();
+        assert_eq!(names(&mut engine, sql), want, "{}", sql);
+    }
+}
+
+#[test]
+fn memory_limit() {
+    let mut engine = nullable_scores();
+    let select = "SELECT * FROM scores ORDER BY score";
+
+    engine.memory_limit = Some(64);
+    let err = engine.execute(parse_query(select).unwrap().1).unwrap_err();
+    assert_eq!(err, EngineError::MemoryLimitExceeded { limit: 64 });
+
+    engine.memory_limit = Some(1 << 20);
+    let rows = engine.execute(parse_query(select).unwrap().1).unwrap();
+    assert_eq!(rows.len(), 3);
+}
+
+#[test]
+fn order_by_expression() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "users",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("name".into(), ValueType::Text),
+        ],
+    );
+    for sql in [
+        "INSERT INTO users VALUES (1, 'Bo')",
+        "INSERT INTO users VALUES (2, 'Alexandra')",
+        "INSERT INTO users VALUES (3, 'Carol')",
+        "INSERT INTO users VALUES (4, 'Zoë')",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+
+    let ids = names(
+        &mut engine,
+        "SELECT id FROM users ORDER BY LENGTH(name) DESC LIMIT 2 OFFSET 1",
+    );
+    assert_eq!(ids, vec![Value::Int(3), Value::Int(4)]);
+
+    let err = engine
+        .execute(
+            parse_query("SELECT id FROM users ORDER BY NOPE(name)")
+                .unwrap()
+                .1,
+        )
+        .unwrap_err();
+    assert_eq!(err, EngineError::UnknownFunction("NOPE".into()));
+}
+
+#[test]
+fn safe_divide() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "ratios",
+        vec![("a".into(), ValueType::Int), ("b".into(), ValueType::Int)],
+    );
+    for sql in [
+        "INSERT INTO ratios VALUES (7, 2)",
+        "INSERT INTO ratios VALUES (5, 0)",
+        "INSERT INTO ratios (a) VALUES (3)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+
+    let rows = engine
+        .execute(
+            parse_query("SELECT a, SAFE_DIVIDE(a, b) FROM ratios")
+                .unwrap()
+                .1,
+        )
+        .unwrap();
+    assert_eq!(
+        rows,
+        vec![
+            vec![Value::Int(7), Value::Int(3)],
+            vec![Value::Int(5), Value::Null],
+            vec![Value::Int(3), Value::Null],
+        ]
+    );
+}
+
+#[test]
+fn parallel_scan_matches_sequential() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "nums",
+        vec![("id".into(), ValueType::Int), ("n".into(), ValueType::Int)],
+    );
+    for i in 0..1000 {
+        let sql = format!("INSERT INTO nums VALUES ({}, {})", i, (i * 7) % 100);
+        engine.execute(parse_query(&sql).unwrap().1).unwrap();
+    }
+    let sql = "SELECT id FROM nums WHERE n>=50";
+
+    let sequential = engine.execute(parse_query(sql).unwrap().1).unwrap();
+    engine.scan_workers = 4;
+    engine.parallel_scan_threshold = 1;
+    let parallel = engine.execute(parse_query(sql).unwrap().1).unwrap();
+
+    assert_eq!(sequential.len(), 500);
+    assert_eq!(parallel, sequential);
+}
+
+#[test]
+fn except_and_intersect() {
+    let mut engine = Engine::new();
+    for table in ["a", "b"] {
+        engine.create_table(
+            table,
+            vec![("x".into(), ValueType::Int), ("y".into(), ValueType::Int)],
+        );
+    }
+    for sql in [
+        "INSERT INTO a VALUES (1, 0)",
+        "INSERT INTO a VALUES (1, 0)",
+        "INSERT INTO a VALUES (1, 0)",
+        "INSERT INTO a VALUES (2, 0)",
+        "INSERT INTO a VALUES (3, 0)",
+        "INSERT INTO b VALUES (1, 0)",
+        "INSERT INTO b VALUES (3, 0)",
+        "INSERT INTO b VALUES (4, 0)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+    let ints = |xs: &[i64]| xs.iter().map(|&x| Value::Int(x)).collect::<Vec<_>>();
+
+    let cases = [
+        ("SELECT x FROM a EXCEPT SELECT x FROM b", ints(&[2])),
+        (
+            "SELECT x FROM a EXCEPT ALL SELECT x FROM b",
+            ints(&[1, 1, 2]),
+        ),
+        ("SELECT x FROM a INTERSECT SELECT x FROM b", ints(&[1, 3])),
+        (
+            "SELECT x FROM a INTERSECT ALL SELECT x FROM b",
+            ints(&[1, 3]),
+        ),
+        (
+            "SELECT x FROM b INTERSECT ALL SELECT x FROM a",
+            ints(&[1, 3]),
+        ),
+    ];
+    for (sql, want) in cases {
+        assert_eq!(names(&mut engine, sql), want, "{}", sql);
+    }
+
+    let err = engine
+        .execute(
+            parse_query("SELECT x FROM a EXCEPT SELECT x, y FROM b")
+                .unwrap()
+                .1,
+        )
+        .unwrap_err();
+    assert_eq!(err, EngineError::ColumnCountMismatch { left: 1, right: 2 });
+}
+
+#[test]
+fn case_insensitive_identifiers() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "users",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("name".into(), ValueType::Text),
+        ],
+    );
+    engine
+        .execute(
+            parse_query("INSERT INTO users VALUES (1, 'Alice')")
+                .unwrap()
+                .1,
+        )
+        .unwrap();
+    let upper = "SELECT NAME FROM USERS WHERE ID=1";
+
+    let err = engine.execute(parse_query(upper).unwrap().1).unwrap_err();
+    assert_eq!(err, EngineError::TableNotFound("USERS".into()));
+
+    engine.case_insensitive = true;
+    engine
+        .execute(
+            parse_query("INSERT INTO Users (ID, Name) VALUES (2, 'Bob')")
+                .unwrap()
+                .1,
+        )
+        .unwrap();
+    assert_eq!(names(&mut engine, upper), vec![Value::Text("Alice".into())]);
+
+    engine.create_table("USERS", vec![("id".into(), ValueType::Int)]);
+    let err = engine.execute(parse_query(upper).unwrap().1).unwrap_err();
+    assert_eq!(err, EngineError::AmbiguousIdentifier("USERS".into()));
+}
+
+#[test]
+fn in_list() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "items",
+        vec![("id".into(), ValueType::Int), ("n".into(), ValueType::Int)],
+    );
+    for i in 0..40 {
+        let sql = format!("INSERT INTO items VALUES ({}, {})", i, i % 10);
+        engine.execute(parse_query(&sql).unwrap().1).unwrap();
+    }
+
+    // Indexed column.
+    let ids = names(
+        &mut engine,
+        "SELECT id FROM items WHERE id IN (7, 3, 99, 3)",
+    );
+    assert_eq!(ids, vec![Value::Int(3), Value::Int(7)]);
+
+    // Linear and set-based matching agree.
+    let sql = "SELECT id FROM items WHERE n IN (1, 2)";
+    let linear = names(&mut engine, sql);
+    engine.in_set_threshold = 0;
+    assert_eq!(names(&mut engine, sql), linear);
+    assert_eq!(linear.len(), 8);
+
+    // NULL matches nothing, whether or not the column is indexed. The
+    // column-list insert stores NULL in the indexed id column.
+    engine
+        .execute(parse_query("INSERT INTO items (n) VALUES (3)").unwrap().1)
+        .unwrap();
+    engine
+        .execute(parse_query("INSERT INTO items (id) VALUES (40)").unwrap().1)
+        .unwrap();
+    for sql in [
+        "SELECT id FROM items WHERE id IN (NULL, 99)",
+        "SELECT id FROM items WHERE id = NULL",
+        "SELECT id FROM items WHERE n IN (NULL, 99)",
+        "SELECT id FROM items WHERE n = NULL",
+    ] {
+        assert_eq!(names(&mut engine, sql), vec![], "{}", sql);
+    }
+    assert_eq!(
+        names(&mut engine, "SELECT n FROM items WHERE id IN (NULL, 3)"),
+        vec![Value::Int(3)]
+    );
+
+    engine.max_in_list = 1;
+    let err = engine.execute(parse_query(sql).unwrap().1).unwrap_err();
+    assert_eq!(err, EngineError::InListTooLarge { limit: 1, found: 2 });
+}
+
+#[test]
+fn column_order_survives_reload() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "t",
+        vec![
+            ("zeta".into(), ValueType::Int),
+            ("alpha".into(), ValueType::Text),
+            ("mid".into(), ValueType::Int),
+        ],
+    );
+    let insert = parse_query("INSERT INTO t VALUES (1, 'a', 2)").unwrap().1;
+    engine.execute(insert).unwrap();
+
+    let path = std::env::temp_dir().join(format!("sql_core_reload_{}.json", std::process::id()));
+    std::fs::write(&path, serde_json::to_vec(&engine.tables).unwrap()).unwrap();
+    let mut reloaded = Engine::new();
+    reloaded.tables = serde_json::from_slice(&std::fs::read(&path).unwrap()).unwrap();
+    std::fs::remove_file(&path).unwrap();
+
+    let cols: Vec<&str> = reloaded.tables["t"]
+        .columns
+        .iter()
+        .map(|c| c.name.as_str())
+        .collect();
+    assert_eq!(cols, vec!["zeta", "alpha", "mid"]);
+    let select = parse_query("SELECT * FROM t WHERE zeta=1").unwrap().1;
+    assert_eq!(
+        reloaded.execute(select).unwrap(),
+        vec![vec![Value::Int(1), Value::Text("a".into()), Value::Int(2)]]
+    );
+}
+
+#[test]
+fn cost_budget() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "items",
+        vec![("id".into(), ValueType::Int), ("n".into(), ValueType::Int)],
+    );
+    for i in 0..64 {
+        let sql = format!("INSERT INTO items VALUES ({}, {})", i, i % 4);
+        engine.execute(parse_query(&sql).unwrap().1).unwrap();
+    }
+    let cost =
+        |engine: &Engine, sql: &str| engine.estimate_cost(&parse_query(sql).unwrap().1).unwrap();
+
+    assert_eq!(cost(&engine, "SELECT * FROM items WHERE id=5"), 1);
+    assert_eq!(
+        cost(&engine, "SELECT * FROM items WHERE id IN (1, 2, 99)"),
+        2
+    );
+    assert_eq!(cost(&engine, "SELECT * FROM items WHERE n=1"), 64);
+    assert_eq!(cost(&engine, "SELECT * FROM items ORDER BY n"), 64 + 64 * 6);
+
+    engine.cost_budget = Some(100);
+    assert_eq!(
+        names(&mut engine, "SELECT id FROM items WHERE id=5"),
+        vec![Value::Int(5)]
+    );
+    let err = engine
+        .execute(parse_query("SELECT * FROM items ORDER BY n").unwrap().1)
+        .unwrap_err();
+    assert_eq!(
+        err,
+        EngineError::CostBudgetExceeded {
+            budget: 100,
+            estimate: 448
+        }
+    );
+}
+
+#[test]
+fn unknown_column_on_empty_result() {
+    let mut engine = Engine::new();
+    engine.create_table("t", vec![("id".into(), ValueType::Int)]);
+    let run = |engine: &mut Engine, sql: &str| engine.execute(parse_query(sql).unwrap().1);
+    for sql in [
+        "SELECT nope FROM t",
+        "SELECT * FROM t ORDER BY nope",
+        "SELECT LENGTH(nope) FROM t",
+    ] {
+        assert_eq!(
+            run(&mut engine, sql),
+            Err(EngineError::ColumnNotFound("nope".into())),
+            "{sql}"
+        );
+    }
+    // A WHERE that matches nothing must not hide the error either.
+    run(&mut engine, "INSERT INTO t VALUES (1)").unwrap();
+    for sql in [
+        "SELECT nope FROM t WHERE id = 2",
+        "SELECT id FROM t WHERE id = 2 ORDER BY id + nope",
+    ] {
+        assert_eq!(
+            run(&mut engine, sql),
+            Err(EngineError::ColumnNotFound("nope".into())),
+            "{sql}"
+        );
+    }
+}
+
+#[test]
+fn default_engine_matches_new() {
+    let engine = Engine::default();
+    assert_eq!(engine.max_in_list, sql_core::DEFAULT_MAX_IN_LIST);
+    assert_eq!(engine.in_set_threshold, sql_core::DEFAULT_IN_SET_THRESHOLD);
+    assert_eq!(engine.scan_workers, 1);
+
+    let mut engine = Engine::default();
+    engine.create_table("t", vec![("id".into(), ValueType::Int)]);
+    engine
+        .execute(parse_query("INSERT INTO t VALUES (1)").unwrap().1)
+        .unwrap();
+    assert_eq!(
+        names(&mut engine, "SELECT id FROM t WHERE id IN (1, 2)"),
+        vec![Value::Int(1)]
+    );
+    // The first column is indexed, as it always was before auto_index.
+    assert!(engine.auto_index);
+    assert!(engine.tables["t"].indices.contains_key("id"));
+}
+
+#[test]
+fn lpad_rpad() {
+    let mut engine = Engine::new();
+    engine.create_table("words", vec![("w".into(), ValueType::Text)]);
+    for sql in [
+        "INSERT INTO words VALUES ('7')",
+        "INSERT INTO words VALUES ('héllo')",
+        "INSERT INTO words VALUES ('日本')",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+    let text = |s: &str| Value::Text(s.into());
+
+    assert_eq!(
+        names(&mut engine, "SELECT LPAD(w, 4, 'ab') FROM words"),
+        vec![text("aba7"), text("héll"), text("ab日本")]
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT RPAD(w, 3, 'ü') FROM words"),
+        vec![text("7üü"), text("hél"), text("日本ü")]
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT LPAD(w, 3, '') FROM words"),
+        vec![text("7"), text("hél"), text("日本")]
+    );
+    for sql in [
+        "SELECT LPAD(w, 9223372036854775807, 'x') FROM words",
+        "SELECT RPAD(w, 1048577, '') FROM words",
+    ] {
+        assert!(
+            matches!(
+                engine.execute(parse_query(sql).unwrap().1),
+                Err(EngineError::InvalidArgument { .. })
+            ),
+            "{sql}"
+        );
+    }
+    assert_eq!(
+        names(&mut engine, "SELECT RPAD(w, 1048576, 'x') FROM words")[0],
+        text(&format!("7{}", "x".repeat(1048575)))
+    );
+}
+
+#[test]
+fn arithmetic_and_division_by_zero() {
+    use sql_core::DivisionByZero;
+
+    let mut engine = Engine::new();
+    engine.create_table(
+        "nums",
+        vec![("a".into(), ValueType::Int), ("b".into(), ValueType::Int)],
+    );
+    for sql in [
+        "INSERT INTO nums VALUES (7, 2)",
+        "INSERT INTO nums VALUES (5, 0)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+
+    assert_eq!(
+        names(&mut engine, "SELECT a + b * 2 - (a - 1) / 2 FROM nums"),
+        vec![Value::Int(8), Value::Int(3)]
+    );
+
+    let sql = "SELECT a / b FROM nums";
+    let err = engine.execute(parse_query(sql).unwrap().1).unwrap_err();
+    assert_eq!(err, EngineError::DivisionByZero);
+
+    engine.division_by_zero = DivisionByZero::Null;
+    assert_eq!(names(&mut engine, sql), vec![Value::Int(3), Value::Null]);
+
+    engine.division_by_zero = DivisionByZero::Sentinel(Value::Int(-1));
+    assert_eq!(names(&mut engine, sql), vec![Value::Int(3), Value::Int(-1)]);
+}
+
+#[test]
+fn json_operators() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "docs",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("data".into(), ValueType::Text),
+        ],
+    );
+    for sql in [
+        r#"INSERT INTO docs VALUES (1, '{"name": "Ann", "age": 31, "tags": ["a", "b"], "pet": {"kind": "cat"}}')"#,
+        r#"INSERT INTO docs VALUES (2, '{"name": null}')"#,
+        "INSERT INTO docs VALUES (3, 'not json')",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+    let rows = engine
+        .execute(
+            parse_query(
+                "SELECT data->>'name', data->>'age', data->'tags'->>1, data -> 'pet', data->'missing'->>'x' FROM docs",
+            )
+            .unwrap()
+            .1,
+        )
+        .unwrap();
+    let text = |s: &str| Value::Text(s.into());
+    assert_eq!(
+        rows,
+        vec![
+            vec![
+                text("Ann"),
+                text("31"),
+                text("b"),
+                text(r#"{"kind":"cat"}"#),
+                Value::Null
+            ],
+            vec![
+                Value::Null,
+                Value::Null,
+                Value::Null,
+                Value::Null,
+                Value::Null
+            ],
+            vec![
+                Value::Null,
+                Value::Null,
+                Value::Null,
+                Value::Null,
+                Value::Null
+            ],
+        ]
+    );
+
+    // Aliases parse and are discarded.
+    assert_eq!(
+        engine
+            .execute(
+                parse_query("SELECT data->>'name' AS name, data->>'age' AS age FROM docs")
+                    .unwrap()
+                    .1
+            )
+            .unwrap(),
+        vec![
+            vec![text("Ann"), text("31")],
+            vec![Value::Null, Value::Null],
+            vec![Value::Null, Value::Null],
+        ]
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT id as key FROM docs WHERE id = 1"),
+        vec![Value::Int(1)]
+    );
+}
+
+#[test]
+fn regexp_condition() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "users",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("name".into(), ValueType::Text),
+        ],
+    );
+    for sql in [
+        "INSERT INTO users VALUES (1, 'Alice')",
+        "INSERT INTO users VALUES (2, 'andre')",
+        "INSERT INTO users VALUES (3, 'Bob')",
+        "INSERT INTO users (id) VALUES (4)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+
+    for sql in [
+        "SELECT id FROM users WHERE name REGEXP '^A.*e$'",
+        "SELECT id FROM users WHERE name ~ '^A.*e$'",
+    ] {
+        assert_eq!(names(&mut engine, sql), vec![Value::Int(1)]);
+    }
+    assert_eq!(
+        names(&mut engine, "SELECT id FROM users WHERE name ~* '^a.*e$'"),
+        vec![Value::Int(1), Value::Int(2)]
+    );
+
+    let err = engine
+        .execute(
+            parse_query("SELECT id FROM users WHERE name ~ '('")
+                .unwrap()
+                .1,
+        )
+        .unwrap_err();
+    assert!(matches!(err, EngineError::InvalidRegex { pattern, .. } if pattern == "("));
+}
+
+#[test]
+fn concat_ws() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "people",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("first".into(), ValueType::Text),
+            ("last".into(), ValueType::Text),
+        ],
+    );
+    for sql in [
+        "INSERT INTO people VALUES (1, 'Ada', 'Lovelace')",
+        "INSERT INTO people (id, last) VALUES (2, 'Hopper')",
+        "INSERT INTO people (id) VALUES (3)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+    assert_eq!(
+        names(
+            &mut engine,
+            "SELECT CONCAT_WS(', ', first, last, id) FROM people"
+        ),
+        vec![
+            Value::Text("Ada, Lovelace, 1".into()),
+            Value::Text("Hopper, 2".into()),
+            Value::Text("3".into()),
+        ]
+    );
+    assert_eq!(
+        names(
+            &mut engine,
+            "SELECT CONCAT_WS('-', first, last) FROM people"
+        ),
+        vec![
+            Value::Text("Ada-Lovelace".into()),
+            Value::Text("Hopper".into()),
+            Value::Text("".into()),
+        ]
+    );
+}
+
+#[test]
+fn ifnull_isnull_match_coalesce() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "people",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("nick".into(), ValueType::Text),
+            ("first".into(), ValueType::Text),
+        ],
+    );
+    for sql in [
+        "INSERT INTO people VALUES (1, 'Ace', 'Ada')",
+        "INSERT INTO people (id, first) VALUES (2, 'Grace')",
+        "INSERT INTO people (id) VALUES (3)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+    let want = vec![
+        Value::Text("Ace".into()),
+        Value::Text("Grace".into()),
+        Value::Null,
+    ];
+    for function in ["COALESCE", "IFNULL", "ISNULL"] {
+        let sql = format!("SELECT {}(nick, first) FROM people", function);
+        assert_eq!(names(&mut engine, &sql), want, "{}", function);
+    }
+    assert_eq!(
+        names(
+            &mut engine,
+            "SELECT COALESCE(nick, first, 'anon') FROM people"
+        ),
+        vec![
+            Value::Text("Ace".into()),
+            Value::Text("Grace".into()),
+            Value::Text("anon".into()),
+        ]
+    );
+    let three = parse_query("SELECT IFNULL(nick, first, 'anon') FROM people")
+        .unwrap()
+        .1;
+    assert!(matches!(
+        engine.execute(three),
+        Err(EngineError::InvalidArgument { .. })
+    ));
+}
+
+#[test]
+fn omitted_insert_columns() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "people",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("name".into(), ValueType::Text),
+        ],
+    );
+    let partial = || parse_query("INSERT INTO people (id) VALUES (1)").unwrap().1;
+    engine.execute(partial()).unwrap();
+    assert_eq!(
+        names(&mut engine, "SELECT name FROM people"),
+        vec![Value::Null]
+    );
+
+    engine.omitted_columns = OmittedColumns::Error;
+    assert_eq!(
+        engine.execute(partial()),
+        Err(EngineError::MissingColumn("name".into()))
+    );
+    engine
+        .execute(
+            parse_query("INSERT INTO people (name, id) VALUES ('Ada', 2)")
+                .unwrap()
+                .1,
+        )
+        .unwrap();
+    assert_eq!(
+        names(&mut engine, "SELECT id FROM people"),
+        vec![Value::Int(1), Value::Int(2)]
+    );
+}
+
+#[test]
+fn to_char_numbers() {
+    let mut engine = Engine::new();
+    engine.create_table("nums", vec![("n".into(), ValueType::Int)]);
+    for n in [1234567, -5, 0, 42] {
+        engine
+            .insert_into("nums", vec![Value::Int(n)], None)
+            .unwrap();
+    }
+    let text = |values: &[&str]| -> Vec<Value> {
+        values.iter().map(|v| Value::Text(v.to_string())).collect()
+    };
+    let cases = [
+        (
+            "9,999,999",
+            vec![" 1,234,567", "        -5", "         0", "        42"],
+        ),
+        ("FM9,999,999", vec!["1,234,567", "-5", "0", "42"]),
+        ("0000", vec![" ####", "-0005", " 0000", " 0042"]),
+        (
+            "FM9,999,990.00",
+            vec!["1,234,567.00", "-5.00", "0.00", "42.00"],
+        ),
+        ("FM9.99", vec!["#.", "-5.", "0.", "#."]),
+    ];
+    for (pattern, want) in cases {
+        let sql = format!("SELECT TO_CHAR(n, '{}') FROM nums", pattern);
+        assert_eq!(names(&mut engine, &sql), text(&want), "{}", pattern);
+    }
+    let bad = parse_query("SELECT TO_CHAR(n, 'YYYY') FROM nums")
+        .unwrap()
+        .1;
+    assert!(matches!(
+        engine.execute(bad),
+        Err(EngineError::InvalidArgument { .. })
+    ));
+}
+
+#[test]
+fn instr_strpos() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "words",
+        vec![("id".into(), ValueType::Int), ("w".into(), ValueType::Text)],
+    );
+    for (id, w) in [(1, "banana"), (2, "crème brûlée"), (3, "kiwi"), (4, "")] {
+        engine
+            .insert_into("words", vec![Value::Int(id), Value::Text(w.into())], None)
+            .unwrap();
+    }
+    engine
+        .insert_into("words", vec![Value::Int(5)], Some(vec!["id".into()]))
+        .unwrap();
+    let ints = |v: &[i64]| -> Vec<Value> {
+        let mut out: Vec<Value> = v.iter().map(|&n| Value::Int(n)).collect();
+        out.push(Value::Null);
+        out
+    };
+    assert_eq!(
+        names(&mut engine, "SELECT INSTR(w, 'an') FROM words"),
+        ints(&[2, 0, 0, 0])
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT STRPOS(w, 'brû') FROM words"),
+        ints(&[0, 7, 0, 0])
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT INSTR(w, '') FROM words"),
+        ints(&[1, 1, 1, 1])
+    );
+}
+
+#[test]
+fn scan_stats() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "users",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("name".into(), ValueType::Text),
+        ],
+    );
+    for id in 0..100 {
+        let name = if id % 10 == 0 { "ten" } else { "other" };
+        engine
+            .insert_into(
+                "users",
+                vec![Value::Int(id), Value::Text(name.into())],
+                None,
+            )
+            .unwrap();
+    }
+    let stats = |sql: &str| match parse_query(sql).unwrap().1 {
+        Query::Select(q) => engine.select_with_stats(&q).unwrap().1,
+        _ => unreachable!(),
+    };
+    assert_eq!(
+        stats("SELECT * FROM users WHERE id = 5"),
+        ScanStats {
+            rows_scanned: 1,
+            rows_returned: 1,
+            index_used: true
+        }
+    );
+    assert_eq!(
+        stats("SELECT * FROM users WHERE name = 'ten' LIMIT 3"),
+        ScanStats {
+            rows_scanned: 100,
+            rows_returned: 3,
+            index_used: false
+        }
+    );
+    assert_eq!(
+        stats("SELECT * FROM users WHERE id IN (1, 2, 500)"),
+        ScanStats {
+            rows_scanned: 2,
+            rows_returned: 2,
+            index_used: true
+        }
+    );
+}
+
+#[test]
+fn unstable_sort_orders_keys() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "events",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("bucket".into(), ValueType::Int),
+        ],
+    );
+    for id in 0..50 {
+        engine
+            .insert_into("events", vec![Value::Int(id), Value::Int(id % 3)], None)
+            .unwrap();
+    }
+    let sql = "SELECT bucket, id FROM events ORDER BY bucket";
+    let stable = names(&mut engine, sql);
+    engine.stable_sort = false;
+    let unstable = names(&mut engine, sql);
+    // Keys come out in the same order either way; only ties may differ.
+    assert_eq!(stable, unstable);
+
+    engine.stable_sort = true;
+    let rows = engine.execute(parse_query(sql).unwrap().1).unwrap();
+    let ids: Vec<&Value> = rows.iter().take(3).map(|r| &r[1]).collect();
+    assert_eq!(ids, [&Value::Int(0), &Value::Int(3), &Value::Int(6)]);
+}
+
+#[test]
+fn default_engine_sorts_stably() {
+    let mut engine = Engine::default();
+    assert!(engine.stable_sort);
+    engine.create_table(
+        "events",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("bucket".into(), ValueType::Int),
+        ],
+    );
+    for id in 0..200 {
+        engine
+            .insert_into("events", vec![Value::Int(id), Value::Int(id % 2)], None)
+            .unwrap();
+    }
+    let rows = engine
+        .execute(
+            parse_query("SELECT id FROM events ORDER BY bucket")
+                .unwrap()
+                .1,
+        )
+        .unwrap();
+    let expected: Vec<Row> = (0..200)
+        .step_by(2)
+        .chain((1..200).step_by(2))
+        .map(|id| vec![Value::Int(id)])
+        .collect();
+    assert_eq!(rows, expected);
+}
+
+#[test]
+fn sign_and_power() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "nums",
+        vec![
+            ("base".into(), ValueType::Int),
+            ("exp".into(), ValueType::Int),
+        ],
+    );
+    for (base, exp) in [(2, 10), (-3, 3), (0, 0), (-2, 0), (7, 1)] {
+        engine
+            .insert_into("nums", vec![Value::Int(base), Value::Int(exp)], None)
+            .unwrap();
+    }
+    let ints = |v: &[i64]| -> Vec<Value> { v.iter().map(|&n| Value::Int(n)).collect() };
+    assert_eq!(
+        names(&mut engine, "SELECT SIGN(base) FROM nums"),
+        ints(&[1, -1, 0, -1, 1])
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT POWER(base, exp) FROM nums"),
+        ints(&[1024, -27, 1, 1, 7])
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT POW(base, exp) FROM nums"),
+        ints(&[1024, -27, 1, 1, 7])
+    );
+    for sql in [
+        "SELECT POWER(base, 0 - 1) FROM nums",
+        "SELECT POWER(base, 100) FROM nums",
+        "SELECT SIGN('x') FROM nums",
+    ] {
+        assert!(
+            matches!(
+                engine.execute(parse_query(sql).unwrap().1),
+                Err(EngineError::InvalidArgument { .. })
+            ),
+            "{}",
+            sql
+        );
+    }
+}
+
+#[test]
+fn auto_index_toggle() {
+    for auto_index in [true, false] {
+        let mut engine = Engine::new();
+        engine.auto_index = auto_index;
+        engine.create_table(
+            "items",
+            vec![("id".into(), ValueType::Int), ("n".into(), ValueType::Int)],
+        );
+        for i in 0..10 {
+            let sql = format!("INSERT INTO items VALUES ({}, {})", i, i * 2);
+            engine.execute(parse_query(&sql).unwrap().1).unwrap();
+        }
+        assert_eq!(
+            engine.tables["items"].indices.contains_key("id"),
+            auto_index
+        );
+
+        let sql = "SELECT n FROM items WHERE id=4";
+        assert_eq!(names(&mut engine, sql), vec![Value::Int(8)]);
+        let cost = engine.estimate_cost(&parse_query(sql).unwrap().1).unwrap();
+        assert_eq!(cost, if auto_index { 1 } else { 10 });
+    }
+}
+
+#[test]
+fn parse_budget() {
+    use sql_core::{parse_query_within, ParseError, DEFAULT_PARSE_BUDGET};
+    use std::time::Duration;
+
+    let list: Vec<String> = (0..5000).map(|i| i.to_string()).collect();
+    let expr = format!("{}1{}", "(".repeat(200), ")".repeat(200));
+    let sql = format!("SELECT {} FROM t WHERE id IN ({})", expr, list.join(", "));
+
+    assert!(parse_query_within(&sql, DEFAULT_PARSE_BUDGET).is_ok());
+    assert_eq!(
+        parse_query_within(&sql, Duration::ZERO),
+        Err(ParseError::Timeout)
+    );
+    assert!(matches!(
+        parse_query_within("SELEC nope", DEFAULT_PARSE_BUDGET),
+        Err(ParseError::Invalid(_))
+    ));
+    // Input left after the statement is rejected, not dropped.
+    for sql in [
+        "SELECT * FROM t WHERE id = 1 OR 1=1",
+        "SELECT * FROM t WHERE s = 'a' x'",
+        "SELECT * FROM t; SELECT * FROM t",
+    ] {
+        assert!(
+            matches!(
+                parse_query_within(sql, DEFAULT_PARSE_BUDGET),
+                Err(ParseError::Invalid(_))
+            ),
+            "{}",
+            sql
+        );
+    }
+    assert!(parse_query_within("SELECT * FROM t ; \n", DEFAULT_PARSE_BUDGET).is_ok());
+    // The deadline does not leak into later plain parses.
+    assert!(parse_query(&sql).is_ok());
+}
+
+#[test]
+fn reindex_rebuilds_stale_indexes() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "users",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("name".into(), ValueType::Text),
+        ],
+    );
+    engine.tables.get_mut("users").unwrap().create_index("name");
+    for (id, name) in [(1, "a"), (2, "b")] {
+        engine
+            .insert_into(
+                "users",
+                vec![Value::Int(id), Value::Text(name.into())],
+                None,
+            )
+            .unwrap();
+    }
+    // A bulk load that bypasses index maintenance leaves both indexes stale.
+    engine
+        .tables
+        .get_mut("users")
+        .unwrap()
+        .rows
+        .push(vec![Value::Int(3), Value::Text("c".into())]);
+    let lookup = |engine: &Engine, sql: &str| match parse_query(sql).unwrap().1 {
+        Query::Select(q) => engine.select_with_stats(&q).unwrap(),
+        _ => unreachable!(),
+    };
+    assert!(lookup(&engine, "SELECT id FROM users WHERE id = 3")
+        .0
+        .is_empty());
+
+    let stats = engine.reindex("users").unwrap();
+    assert_eq!((stats.indexes, stats.rows), (2, 3));
+    for sql in [
+        "SELECT id FROM users WHERE id = 3",
+        "SELECT id FROM users WHERE name = 'c'",
+    ] {
+        let (rows, scan) = lookup(&engine, sql);
+        assert_eq!(rows, vec![vec![Value::Int(3)]], "{sql}");
+        assert!(scan.index_used && scan.rows_scanned == 1, "{sql}");
+    }
+    assert!(matches!(
+        engine.reindex("nope"),
+        Err(EngineError::TableNotFound(_))
+    ));
+}
+
+#[test]
+fn quoted_null_and_negative_literals() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "t",
+        vec![("n".into(), ValueType::Int), ("s".into(), ValueType::Text)],
+    );
+    for sql in [
+        "INSERT INTO t VALUES (-5, 'it''s')",
+        "INSERT INTO t VALUES (NULL, '''')",
+        "INSERT INTO t VALUES (-9223372036854775808, null)",
+    ] {
+        engine.execute(parse_query(sql).unwrap().1).unwrap();
+    }
+    let text = |s: &str| Value::Text(s.into());
+    assert_eq!(
+        names(&mut engine, "SELECT s FROM t"),
+        vec![text("it's"), text("'"), Value::Null]
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT s FROM t WHERE s = 'it''s'"),
+        vec![text("it's")]
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT n * -2 FROM t WHERE n = -5"),
+        vec![Value::Int(10)]
+    );
+    assert_eq!(
+        names(&mut engine, "SELECT n - 1 FROM t WHERE n IN (-5, 7)"),
+        vec![Value::Int(-6)]
+    );
+    // The inserted NULL lands in the indexed first column; neither the
+    // index nor a scan matches it against a NULL literal.
+    for sql in [
+        "SELECT s FROM t WHERE n = NULL",
+        "SELECT s FROM t WHERE n IN (NULL)",
+        "SELECT n FROM t WHERE s = NULL",
+    ] {
+        assert_eq!(names(&mut engine, sql), vec![], "{}", sql);
+    }
+    // A quote that is not doubled still ends the literal.
+    let (rest, _) = parse_query("SELECT s FROM t WHERE s = 'a' x'").unwrap();
+    assert_eq!(rest, "x'");
+}
+
+#[test]
+fn trailing_semicolon() {
+    let mut engine = Engine::new();
+    engine.create_table("users", vec![("name".into(), ValueType::Text)]);
+    engine
+        .execute(parse_query("INSERT INTO users VALUES ('a;b');").unwrap().1)
+        .unwrap();
+
+    for sql in [
+        "SELECT name FROM users",
+        "SELECT name FROM users;",
+        "SELECT name FROM users ;",
+        "  SELECT name FROM users\n\t;  \n",
+    ] {
+        let (rest, query) = parse_query(sql).unwrap();
+        assert_eq!(rest, "", "{sql:?}");
+        assert_eq!(
+            engine.execute(query).unwrap(),
+            vec![vec![Value::Text("a;b".into())]],
+            "{sql:?}"
+        );
+    }
+    // Only one semicolon belongs to the statement; what follows is not
+    // treated as an empty second statement.
+    assert_eq!(parse_query("SELECT name FROM users;;").unwrap().0, ";");
+    assert_eq!(
+        parse_query("SELECT name FROM users; SELECT").unwrap().0,
+        "SELECT"
+    );
+}
+
+#[test]
+fn nesting_limit() {
+    use sql_core::{parse_query_limited, ParseError, DEFAULT_MAX_NESTING, DEFAULT_PARSE_BUDGET};
+
+    let nested =
+        |depth: usize| format!("SELECT {}1{} FROM t", "(".repeat(depth), ")".repeat(depth));
+    assert!(parse_query_limited(&nested(15), DEFAULT_PARSE_BUDGET, 16).is_ok());
+    assert!(matches!(
+        parse_query_limited(
+            "SELECT * FROM t WHERE id = 1 OR 1=1",
+            DEFAULT_PARSE_BUDGET,
+            16
+        ),
+        Err(ParseError::Invalid(_))
+    ));
+    assert_eq!(
+        parse_query_limited(&nested(16), DEFAULT_PARSE_BUDGET, 16),
+        Err(ParseError::TooDeep { limit: 16 })
+    );
+    let calls = format!("SELECT {}w{} FROM t", "LENGTH(".repeat(20), ")".repeat(20));
+    assert_eq!(
+        parse_query_limited(&calls, DEFAULT_PARSE_BUDGET, 16),
+        Err(ParseError::TooDeep { limit: 16 })
+    );
+    // Far deeper input is rejected by the default limit instead of
+    // overflowing the stack, and plain parses are bounded too.
+    assert_eq!(
+        parse_query_within(&nested(100_000), DEFAULT_PARSE_BUDGET),
+        Err(ParseError::TooDeep {
+            limit: DEFAULT_MAX_NESTING
+        })
+    );
+    assert!(parse_query(&nested(100_000)).is_err());
+    assert!(parse_query(&nested(200)).is_ok());
+}
+
+#[test]
+fn unordered_select_keeps_insertion_order() {
+    let mut engine = Engine::new();
+    engine.create_table(
+        "events",
+        vec![
+            ("id".into(), ValueType::Int),
+            ("seq".into(), ValueType::Int),
+        ],
+    );
+    for (seq, id) in [5, 3, 5, 1, 3, 5].into_iter().enumerate() {
+        let sql = format!("INSERT INTO events VALUES ({}, {})", id, seq);
+        engine.execute(parse_query(&sql).unwrap().1).unwrap();
+    }
+    let seqs = |engine: &mut Engine, sql: &str| -> Vec<Value> {
+        engine
+            .execute(parse_query(sql).unwrap().1)
+            .unwrap()
+            .into_iter()
+            .map(|r| r[1].clone())
+            .collect()
+    };
+    let ints = |v: &[i64]| v.iter().map(|&n| Value::Int(n)).collect::<Vec<_>>();
+
+    assert_eq!(
+        seqs(&mut engine, "SELECT * FROM events"),
+        ints(&[0, 1, 2, 3, 4, 5])
+    );
+    // Index lookups.
+    assert_eq!(
+        seqs(&mut engine, "SELECT * FROM events WHERE id=5"),
+        ints(&[0, 2, 5])
+    );
+    assert_eq!(
+        seqs(&mut engine, "SELECT * FROM events WHERE id IN (5, 3)"),
+        ints(&[0, 1, 2, 4, 5])
+    );
+    // Full and parallel scans.
+    let sql = "SELECT * FROM events WHERE seq>=1";
+    assert_eq!(seqs(&mut engine, sql), ints(&[1, 2, 3, 4, 5]));
+    engine.scan_workers = 4;
+    engine.parallel_scan_threshold = 1;
+    assert_eq!(seqs(&mut engine, sql), ints(&[1, 2, 3, 4, 5]));
+}
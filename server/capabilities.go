@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Capabilities is the body of GET /capabilities, letting clients and
+// drivers discover what this server accepts.
+type Capabilities struct {
+	Formats        []string       `json:"formats"`
+	ExportFormats  []string       `json:"export_formats"`
+	Core           CoreFeatures   `json:"core"`
+	Auth           []string       `json:"auth"`
+	Pagination     []string       `json:"pagination"`
+	PaginationMeta []string       `json:"pagination_meta"`
+	HashModes      []string       `json:"hash_modes"`
+	Flags          []string       `json:"flags,omitempty"`
+	Limits         map[string]int `json:"limits"`
+}
+
+// CoreFeatures describes the SQL grammar of the Rust core crate for
+// drivers that embed it. The Go /query engine does not evaluate these,
+// so they are reported apart from what the server itself accepts.
+type CoreFeatures struct {
+	Statements   []string `json:"statements"`
+	SetOperators []string `json:"set_operators"`
+	Functions    []string `json:"functions"`
+}
+
+// coreFeatures is maintained by hand alongside core/src/parser.rs (the
+// Query and SetOperator variants) and functions::call.
+var coreFeatures = CoreFeatures{
+	Statements:   []string{"SELECT", "INSERT"},
+	SetOperators: []string{"EXCEPT", "EXCEPT ALL", "INTERSECT", "INTERSECT ALL"},
+	Functions: []string{
+		"COALESCE", "CONCAT_WS", "IFNULL", "INSTR", "ISNULL", "LENGTH", "LPAD",
+		"POW", "POWER", "RPAD", "SAFE_DIVIDE", "SIGN", "STRPOS", "TO_CHAR",
+	},
+}
+
+// capabilities describes the server as configured. Apart from Core, every
+// list comes from the tables the handlers themselves consult, so it
+// cannot drift from what they accept.
+func capabilities(e *Engine) Capabilities {
+	var c Capabilities
+	for f := range formatContentTypes {
+		c.Formats = append(c.Formats, f)
+	}
+	sort.Strings(c.Formats)
+	c.ExportFormats = exportFormats
+	c.Core = coreFeatures
+
+	c.Auth = []string{"bearer"}
+	if os.Getenv("DEV_MODE") == "1" || os.Getenv("API_TOKEN") == "" {
+		c.Auth = []string{"none"}
+	}
+	c.Pagination = []string{"offset"}
+	c.PaginationMeta = []string{paginationBody, paginationHeaders, paginationBoth}
+	c.HashModes = []string{hashRows, hashResult}
+	if os.Getenv("DEV_MODE") == "1" {
+		for f := range knownFlags {
+			c.Flags = append(c.Flags, f)
+		}
+		sort.Strings(c.Flags)
+	}
+
+	timeout := e.timeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	maxColumns := e.maxColumns
+	if maxColumns <= 0 {
+		maxColumns = DefaultMaxColumns
+	}
+	c.Limits = map[string]int{
+		"default_timeout_ms": int(timeout.Milliseconds()),
+		"max_result_columns": maxColumns,
+	}
+	if e.maxTimeout > 0 {
+		c.Limits["max_timeout_ms"] = int(e.maxTimeout.Milliseconds())
+	}
+	if n, _ := strconv.Atoi(os.Getenv("MAX_RESPONSE_BYTES")); n > 0 {
+		c.Limits["max_response_bytes"] = n
+	}
+	return c
+}
+
+// handleCapabilities serves GET /capabilities. It needs no auth, and the
+// answer only changes on restart, so clients may cache it.
+func handleCapabilities(e *Engine) http.HandlerFunc {
+	body, _ := json.Marshal(capabilities(e))
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write(append(body, '\n'))
+	}
+}
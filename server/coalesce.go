@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// flightGroup coalesces identical concurrent queries: while one caller is
+// executing a key, later callers with the same key wait for it and share
+// its result instead of running the query again. Nothing is kept once the
+// call finishes, so results are never served stale. The zero value is
+// ready to use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	resp QueryResponse
+	err  error
+}
+
+// do runs fn once for all concurrent callers of key. An error is not
+// shared: a caller that joined a failed flight runs fn itself, so a
+// timeout or cancellation of the first caller's request never leaks into
+// the others. A waiting caller whose own ctx ends stops waiting at once.
+// Each caller that joins a flight is counted in /stats.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (QueryResponse, error)) (QueryResponse, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		stats.coalesced.Add(1)
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return QueryResponse{}, contextError(ctx)
+		}
+		if f.err == nil {
+			return f.resp, nil
+		}
+		return fn()
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.resp, f.err = fn()
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.resp, f.err
+}
+
+// collapseSpace returns sql with each run of whitespace outside string
+// literals replaced by one space, and the ends trimmed. Literals are
+// tracked as in splitStatements, so their contents are kept byte for
+// byte.
+func collapseSpace(sql string) string {
+	var b strings.Builder
+	inString := false
+	pending := false
+	for _, c := range strings.TrimSpace(sql) {
+		switch {
+		case c == '\'':
+			inString = !inString
+		case !inString && unicode.IsSpace(c):
+			pending = true
+			continue
+		}
+		if pending {
+			b.WriteByte(' ')
+			pending = false
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// coalesceKey identifies requests that must return the same result: the
+// SQL with whitespace runs outside literals collapsed, plus the
+// pagination and timeout. It reports false for anything but a read, so
+// writes always execute.
+func coalesceKey(req QueryRequest) (string, bool) {
+	sql := collapseSpace(req.SQL)
+	verb, _, _ := strings.Cut(sql, " ")
+	if !strings.EqualFold(verb, "SELECT") {
+		return "", false
+	}
+	return fmt.Sprintf("%d\x00%d\x00%d\x00%s", req.Limit, req.Offset, req.TimeoutMS, sql), true
+}
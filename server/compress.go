@@ -0,0 +1,64 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// gzipLevelFromEnv returns the compression level configured with
+// GZIP_LEVEL. Valid values range from flate.BestSpeed to
+// flate.BestCompression; anything else falls back to the balanced
+// default.
+func gzipLevelFromEnv() int {
+	v := os.Getenv("GZIP_LEVEL")
+	if v == "" {
+		return gzip.DefaultCompression
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < flate.BestSpeed || n > flate.BestCompression {
+		slog.Warn("invalid GZIP_LEVEL, using default", "value", v)
+		return gzip.DefaultCompression
+	}
+	return n
+}
+
+// acceptsGzip reports whether the client listed gzip in Accept-Encoding
+// without disabling it via q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err != nil || q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses everything written to the response.
+// Flush pushes compressed data through so streaming formats still send
+// rows as they are produced.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	return g.gz.Write(p)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	g.gz.Flush()
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// DiffRequest asks which rows of SQL changed relative to a baseline. The
+// baseline is either the result of BaseSQL or the rows a client received
+// earlier (Previous, in the same column order). Rows are matched on the
+// Key columns.
+type DiffRequest struct {
+	SQL      string          `json:"sql"`
+	BaseSQL  string          `json:"base_sql,omitempty"`
+	Previous [][]interface{} `json:"previous,omitempty"`
+	Key      []string        `json:"key"`
+}
+
+// DiffResponse lists rows present only in the new result (added), only in
+// the baseline (removed), and rows whose key exists in both but whose
+// values differ (changed, with the new values).
+type DiffResponse struct {
+	Columns []string        `json:"columns,omitempty"`
+	Added   [][]interface{} `json:"added"`
+	Removed [][]interface{} `json:"removed"`
+	Changed [][]interface{} `json:"changed"`
+}
+
+func handleDiff(e *Engine) http.HandlerFunc {
+	token := os.Getenv("API_TOKEN")
+	devMode := os.Getenv("DEV_MODE") == "1"
+	verboseErrors := verboseErrorsFromEnv()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token, devMode) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		var req DiffRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(req.Key) == 0 {
+			writeError(w, http.StatusBadRequest, "key columns are required")
+			return
+		}
+
+		current, err := runQuery(r.Context(), e, QueryRequest{SQL: req.SQL})
+		if err != nil {
+			writeQueryError(w, err, req.SQL, verboseErrors)
+			return
+		}
+		base := req.Previous
+		if req.BaseSQL != "" {
+			prev, err := runQuery(r.Context(), e, QueryRequest{SQL: req.BaseSQL})
+			if err != nil {
+				writeQueryError(w, err, req.BaseSQL, verboseErrors)
+				return
+			}
+			base = prev.Rows
+		}
+
+		resp, err := diffRows(current.Columns, req.Key, base, current.Rows)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// queryAPIError converts an Engine.Query error to its API error, whose
+// code is the HTTP status the error maps to.
+func queryAPIError(err error) *APIError {
+	if errors.Is(err, ErrQueryTimeout) {
+		return &APIError{Code: http.StatusRequestTimeout, Message: "timeout"}
+	}
+	return &APIError{Code: http.StatusBadRequest, Message: err.Error()}
+}
+
+// diffRows compares base and current keyed on the key columns. Values are
+// compared by their JSON encoding so rows decoded from a client match
+// rows produced by the engine.
+func diffRows(columns, key []string, base, current [][]interface{}) (DiffResponse, error) {
+	idx := make([]int, len(key))
+	for i, k := range key {
+		idx[i] = -1
+		for j, c := range columns {
+			if c == k {
+				idx[i] = j
+			}
+		}
+		if idx[i] < 0 {
+			return DiffResponse{}, fmt.Errorf("key column %q not in result", k)
+		}
+	}
+
+	index := func(rows [][]interface{}, which string) (map[string]string, []string, error) {
+		m := make(map[string]string, len(rows))
+		order := make([]string, 0, len(rows))
+		for _, row := range rows {
+			if len(row) != len(columns) {
+				return nil, nil, fmt.Errorf("%s row has %d values, expected %d", which, len(row), len(columns))
+			}
+			vals := make([]interface{}, len(idx))
+			for i, j := range idx {
+				vals[i] = row[j]
+			}
+			k, _ := json.Marshal(vals)
+			if _, dup := m[string(k)]; dup {
+				return nil, nil, fmt.Errorf("duplicate key %s in %s rows", k, which)
+			}
+			v, _ := json.Marshal(row)
+			m[string(k)] = string(v)
+			order = append(order, string(k))
+		}
+		return m, order, nil
+	}
+	baseIdx, baseOrder, err := index(base, "base")
+	if err != nil {
+		return DiffResponse{}, err
+	}
+	curIdx, curOrder, err := index(current, "current")
+	if err != nil {
+		return DiffResponse{}, err
+	}
+
+	resp := DiffResponse{
+		Columns: columns,
+		Added:   [][]interface{}{},
+		Removed: [][]interface{}{},
+		Changed: [][]interface{}{},
+	}
+	for i, k := range curOrder {
+		old, ok := baseIdx[k]
+		switch {
+		case !ok:
+			resp.Added = append(resp.Added, current[i])
+		case old != curIdx[k]:
+			resp.Changed = append(resp.Changed, current[i])
+		}
+	}
+	for i, k := range baseOrder {
+		if _, ok := curIdx[k]; !ok {
+			resp.Removed = append(resp.Removed, base[i])
+		}
+	}
+	return resp, nil
+}
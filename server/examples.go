@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ExamplesResponse is the body of GET /examples.
+type ExamplesResponse struct {
+	Queries []string `json:"queries"`
+}
+
+// exampleQueries returns a few illustrative SELECTs generated from e's
+// schema.
+func (e *Engine) exampleQueries() []string {
+	queries := []string{
+		fmt.Sprintf("SELECT * FROM %s LIMIT 10", e.table),
+	}
+	if len(e.columns) > 0 {
+		queries = append(queries,
+			fmt.Sprintf("SELECT %s FROM %s", strings.Join(e.columns, ", "), e.table),
+			fmt.Sprintf("SELECT * FROM %s ORDER BY %s DESC", e.table, e.columns[0]),
+		)
+	}
+	return queries
+}
+
+// handleExamples serves GET /examples, which lists example queries for
+// the loaded schema to help new users get started. It only answers in
+// DEV_MODE; elsewhere the endpoint does not exist.
+func handleExamples(e *Engine) http.HandlerFunc {
+	devMode := os.Getenv("DEV_MODE") == "1"
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !devMode {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ExamplesResponse{Queries: e.exampleQueries()})
+	}
+}
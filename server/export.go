@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+)
+
+// formatNDJSON is the extra format /export offers: one JSON object per
+// row, newline-delimited.
+const formatNDJSON = "ndjson"
+
+// exportFormats lists the formats /export accepts.
+var exportFormats = []string{formatCSV, formatNDJSON}
+
+// Export returns all rows of table, ignoring any result limits. The
+// rows are shared with the engine and must not be modified.
+func (e *Engine) Export(table string) (QueryResponse, error) {
+	if table != e.table {
+		return QueryResponse{}, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	return QueryResponse{Columns: e.columns, Rows: e.rows}, nil
+}
+
+// writeNDJSON streams resp as one JSON object per row, flushing as policy
+// allows so the whole table is never encoded in memory at once. It stops
+// with ctx's error if ctx is cancelled mid-stream.
+func writeNDJSON(ctx context.Context, w http.ResponseWriter, resp QueryResponse, policy flushPolicy) error {
+	enc := json.NewEncoder(w)
+	flusher := newRowFlusher(w, policy)
+	obj := make(map[string]interface{}, len(resp.Columns))
+	for _, row := range resp.Rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for i, c := range resp.Columns {
+			obj[c] = row[i]
+		}
+		if err := enc.Encode(obj); err != nil {
+			return err
+		}
+		flusher.row()
+	}
+	return nil
+}
+
+// handleExport serves GET /export?table=...&format=csv|ndjson, streaming
+// a whole table as a download. Because it bypasses result limits it is
+// disabled unless the operator sets EXPORT_ENABLED=1. Repeated column
+// names follow DUPLICATE_COLUMNS as in /query; NDJSON is keyed by name.
+func handleExport(e *Engine) http.HandlerFunc {
+	token := os.Getenv("API_TOKEN")
+	devMode := os.Getenv("DEV_MODE") == "1"
+	enabled := os.Getenv("EXPORT_ENABLED") == "1"
+	flushEvery := flushPolicyFromEnv()
+	dupColumns := duplicateColumnsFromEnv()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			http.NotFound(w, r)
+			return
+		}
+		if !authorized(r, token, devMode) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		q := r.URL.Query()
+		table := q.Get("table")
+		if table == "" {
+			writeError(w, http.StatusBadRequest, "table parameter is required")
+			return
+		}
+		format := q.Get("format")
+		if format == "" {
+			format = formatCSV
+		}
+		if !slices.Contains(exportFormats, format) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported export format %q", format))
+			return
+		}
+		resp, err := e.Export(table)
+		if errors.Is(err, ErrTableNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if resp.Columns, err = dedupeColumns(resp.Columns, dupColumns, format == formatNDJSON); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		contentType := "application/x-ndjson"
+		if format == formatCSV {
+			contentType = formatContentTypes[formatCSV]
+		}
+		w.Header().Set("Content-Type", contentType)
+		// table has been matched against the schema, so it is safe to
+		// use in the header.
+		w.Header().Set("Content-Disposition", `attachment; filename="`+table+"."+format+`"`)
+		w.WriteHeader(http.StatusOK)
+		if format == formatCSV {
+			err = writeCSV(r.Context(), w, resp, 0, flushEvery)
+		} else {
+			err = writeNDJSON(r.Context(), w, resp, flushEvery)
+		}
+		if err != nil {
+			slog.Warn("export stream aborted", "table", table, "err", err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// flagCoalesce turns coalescing of identical concurrent reads on or off
+// for one request, overriding COALESCE_QUERIES.
+const flagCoalesce = "coalesce"
+
+// knownFlags lists the per-request feature flags runQuery understands.
+var knownFlags = map[string]bool{
+	flagCoalesce: true,
+}
+
+// checkFlags validates a request's feature flags. Flags change how the
+// server executes queries, so they are rejected outside dev mode, and
+// unknown names are rejected so a typo never silently runs the default.
+func checkFlags(flags map[string]bool, devMode bool) error {
+	if len(flags) == 0 {
+		return nil
+	}
+	if !devMode {
+		return errors.New("feature flags require DEV_MODE")
+	}
+	var unknown []string
+	for name := range flags {
+		if !knownFlags[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown flags: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
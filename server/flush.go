@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// flushPolicy controls how often streamed formats (CSV, NDJSON) push
+// buffered output to the client. A flush happens once rows rows have
+// been written or interval has passed since the last flush, whichever
+// comes first; a zero field never triggers. Flushing every row gives the
+// lowest latency, larger batches mean fewer, bigger chunks.
+type flushPolicy struct {
+	rows     int
+	interval time.Duration
+}
+
+// flushEveryRow is the default: each row reaches the client at once.
+var flushEveryRow = flushPolicy{rows: 1}
+
+// flushPolicyFromEnv reads STREAM_FLUSH_ROWS and STREAM_FLUSH_MS. With
+// neither set, every row is flushed.
+func flushPolicyFromEnv() flushPolicy {
+	var p flushPolicy
+	if n, err := strconv.Atoi(os.Getenv("STREAM_FLUSH_ROWS")); err == nil && n > 0 {
+		p.rows = n
+	}
+	if ms, err := strconv.Atoi(os.Getenv("STREAM_FLUSH_MS")); err == nil && ms > 0 {
+		p.interval = time.Duration(ms) * time.Millisecond
+	}
+	if p == (flushPolicy{}) {
+		return flushEveryRow
+	}
+	return p
+}
+
+// rowFlusher applies a flushPolicy to w. The interval is checked as rows
+// are written, so a stalled producer does not trigger a flush by itself.
+type rowFlusher struct {
+	f       http.Flusher
+	policy  flushPolicy
+	pending int
+	last    time.Time
+}
+
+func newRowFlusher(w http.ResponseWriter, p flushPolicy) *rowFlusher {
+	f, _ := w.(http.Flusher)
+	return &rowFlusher{f: f, policy: p, last: time.Now()}
+}
+
+// row records that a row was written and flushes if the policy says so.
+func (r *rowFlusher) row() {
+	r.pending++
+	if r.policy.rows > 0 && r.pending >= r.policy.rows ||
+		r.policy.interval > 0 && time.Since(r.last) >= r.policy.interval {
+		r.flush()
+	}
+}
+
+// flush pushes everything written so far to the client.
+func (r *rowFlusher) flush() {
+	if r.f != nil {
+		r.f.Flush()
+	}
+	r.pending = 0
+	r.last = time.Now()
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Response formats selectable with ?format= or the Accept header.
+const (
+	formatJSON     = "json"
+	formatCSV      = "csv"
+	formatColumnar = "columnar"
+)
+
+var formatContentTypes = map[string]string{
+	formatJSON:     "application/json",
+	formatCSV:      "text/csv",
+	formatColumnar: "application/json",
+}
+
+// defaultFormatFromEnv returns the DEFAULT_FORMAT operators configured
+// for requests that do not choose one, or JSON if unset. An unknown value
+// is an error, which main treats as fatal.
+func defaultFormatFromEnv() (string, error) {
+	f := os.Getenv("DEFAULT_FORMAT")
+	if f == "" {
+		return formatJSON, nil
+	}
+	if _, ok := formatContentTypes[f]; !ok {
+		return formatJSON, fmt.Errorf("unsupported DEFAULT_FORMAT %q", f)
+	}
+	return f, nil
+}
+
+// responseFormat picks the output format for r. An explicit ?format=
+// parameter wins over the Accept header, which wins over def.
+func responseFormat(r *http.Request, def string) (string, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := formatContentTypes[f]; !ok {
+			return "", fmt.Errorf("unsupported format %q", f)
+		}
+		return f, nil
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return formatCSV, nil
+	case strings.Contains(accept, "application/json"):
+		return formatJSON, nil
+	}
+	return def, nil
+}
+
+// ColumnarResponse is the ?format=columnar body: one array of values per
+// column instead of one array per row.
+type ColumnarResponse struct {
+	Columns   []string                 `json:"columns"`
+	Data      map[string][]interface{} `json:"data"`
+	Truncated bool                     `json:"truncated,omitempty"`
+	Warnings  []string                 `json:"warnings,omitempty"`
+}
+
+// columnar transposes resp into column-oriented form.
+func columnar(resp QueryResponse) ColumnarResponse {
+	out := ColumnarResponse{
+		Columns:   resp.Columns,
+		Data:      make(map[string][]interface{}, len(resp.Columns)),
+		Truncated: resp.Truncated,
+		Warnings:  resp.Warnings,
+	}
+	if out.Columns == nil {
+		out.Columns = []string{}
+	}
+	for i, c := range resp.Columns {
+		values := make([]interface{}, len(resp.Rows))
+		for j, row := range resp.Rows {
+			values[j] = row[i]
+		}
+		out.Data[c] = values
+	}
+	return out
+}
+
+// ErrResponseTooLarge is returned when a serialized response would exceed
+// MAX_RESPONSE_BYTES.
+var ErrResponseTooLarge = errors.New("response too large")
+
+// cappedWriter passes writes through until remaining is used up and
+// rejects, unwritten, any write that would go past it.
+type cappedWriter struct {
+	w         io.Writer
+	remaining int
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if len(p) > c.remaining {
+		return 0, ErrResponseTooLarge
+	}
+	c.remaining -= len(p)
+	return c.w.Write(p)
+}
+
+// writeCSV streams resp as CSV: the header row first, then one record per
+// row, flushing as policy allows so large exports are not held in memory.
+// The header is always flushed at once. It stops early with ctx's error
+// if ctx is cancelled mid-stream. When maxBytes is positive the stream
+// ends before the first record that would exceed it, with
+// ErrResponseTooLarge.
+func writeCSV(ctx context.Context, w http.ResponseWriter, resp QueryResponse, maxBytes int, policy flushPolicy) error {
+	var out io.Writer = w
+	if maxBytes > 0 {
+		out = &cappedWriter{w: w, remaining: maxBytes}
+	}
+	// Each record is encoded into buf and handed to out in a single
+	// write, so a rejected write never leaves half a row behind.
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	write := func() error {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		_, err := out.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	flusher := newRowFlusher(w, policy)
+
+	if err := cw.Write(resp.Columns); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	flusher.flush()
+	record := make([]string, 0, len(resp.Columns))
+	for _, row := range resp.Rows {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record = record[:0]
+		for _, v := range row {
+			record = append(record, csvValue(v))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		if err := write(); err != nil {
+			return err
+		}
+		flusher.row()
+	}
+	return nil
+}
+
+// csvValue renders a single cell. NULL becomes an empty field.
+func csvValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// Identifier quoting styles accepted by IDENTIFIER_QUOTING.
+const (
+	quoteNone     = "none"
+	quoteDouble   = "double"
+	quoteBacktick = "backtick"
+)
+
+// identifierQuotingFromEnv returns the configured column name quoting
+// style, defaulting to unquoted output.
+func identifierQuotingFromEnv() string {
+	switch v := os.Getenv("IDENTIFIER_QUOTING"); v {
+	case "", quoteNone:
+		return quoteNone
+	case quoteDouble, quoteBacktick:
+		return v
+	default:
+		slog.Warn("unknown IDENTIFIER_QUOTING, using none", "value", v)
+		return quoteNone
+	}
+}
+
+// quoteIdentifiers returns columns quoted in the given style, doubling
+// any embedded quote characters. The input slice is not modified.
+func quoteIdentifiers(columns []string, style string) []string {
+	var q string
+	switch style {
+	case quoteDouble:
+		q = `"`
+	case quoteBacktick:
+		q = "`"
+	default:
+		return columns
+	}
+	out := make([]string, len(columns))
+	for i, c := range columns {
+		out[i] = q + strings.ReplaceAll(c, q, q+q) + q
+	}
+	return out
+}
+
+// Duplicate column name policies accepted by DUPLICATE_COLUMNS.
+const (
+	dupSuffix = "suffix" // id, id_1
+	dupError  = "error"
+	dupKeep   = "keep"
+)
+
+// duplicateColumnsFromEnv returns the configured duplicate column policy,
+// or "" to use the per-format default.
+func duplicateColumnsFromEnv() string {
+	switch v := os.Getenv("DUPLICATE_COLUMNS"); v {
+	case "", dupSuffix, dupError, dupKeep:
+		return v
+	default:
+		slog.Warn("unknown DUPLICATE_COLUMNS, using default", "value", v)
+		return ""
+	}
+}
+
+// dedupeColumns applies policy to repeated names in columns. Without a
+// policy, output keyed by column name (objects is set) gets suffixes and
+// row arrays keep the names as they are. Keeping a repeated name is an
+// error when objects is set, since one of the values would be lost. A
+// suffix never reuses a name already in the result. The input slice is
+// not modified.
+func dedupeColumns(columns []string, policy string, objects bool) ([]string, error) {
+	if policy == "" {
+		policy = dupKeep
+		if objects {
+			policy = dupSuffix
+		}
+	}
+	taken := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		taken[c] = true
+	}
+	seen := make(map[string]bool, len(columns))
+	var out []string
+	for i, c := range columns {
+		if !seen[c] {
+			seen[c] = true
+			continue
+		}
+		switch policy {
+		case dupKeep:
+			if objects {
+				return nil, fmt.Errorf("duplicate column %q cannot be kept in output keyed by column name", c)
+			}
+			return columns, nil
+		case dupError:
+			return nil, fmt.Errorf("duplicate column %q in result", c)
+		}
+		if out == nil {
+			out = append([]string(nil), columns...)
+		}
+		for n := 1; ; n++ {
+			name := fmt.Sprintf("%s_%d", c, n)
+			if !taken[name] {
+				taken[name] = true
+				out[i] = name
+				break
+			}
+		}
+	}
+	if out == nil {
+		return columns, nil
+	}
+	return out, nil
+}
+
+// keyedRows returns resp's rows as objects mapping column name to value,
+// keyed by the value of column key. names are the column names used in
+// the objects and may differ from resp.Columns by quoting. A duplicate
+// key is an error unless lastWins is set, in which case the later row
+// replaces the earlier one.
+func keyedRows(resp QueryResponse, names []string, key string, lastWins bool) (map[string]map[string]interface{}, error) {
+	idx := -1
+	for i, c := range resp.Columns {
+		if c == key {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("key column %q not in result", key)
+	}
+	out := make(map[string]map[string]interface{}, len(resp.Rows))
+	for _, row := range resp.Rows {
+		if row[idx] == nil {
+			return nil, fmt.Errorf("key column %q is NULL", key)
+		}
+		k := fmt.Sprint(row[idx])
+		if _, dup := out[k]; dup && !lastWins {
+			return nil, fmt.Errorf("duplicate key %s in column %q", k, key)
+		}
+		obj := make(map[string]interface{}, len(names))
+		for i, v := range row {
+			obj[names[i]] = v
+		}
+		out[k] = obj
+	}
+	return out, nil
+}
+
+// selectFields returns resp with only the columns named in fields, in
+// that order. Every field must be a result column and appear once. Rows
+// are copied; the input is not modified.
+func selectFields(resp QueryResponse, fields []string) (QueryResponse, error) {
+	index := make(map[string]int, len(resp.Columns))
+	for i, c := range resp.Columns {
+		if _, dup := index[c]; !dup {
+			index[c] = i
+		}
+	}
+	picks := make([]int, len(fields))
+	seen := make(map[string]bool, len(fields))
+	for i, f := range fields {
+		idx, ok := index[f]
+		if !ok {
+			return resp, fmt.Errorf("field %q not in result", f)
+		}
+		if seen[f] {
+			return resp, fmt.Errorf("field %q requested twice", f)
+		}
+		seen[f] = true
+		picks[i] = idx
+	}
+	rows := make([][]interface{}, len(resp.Rows))
+	for i, row := range resp.Rows {
+		out := make([]interface{}, len(picks))
+		for j, idx := range picks {
+			out[j] = row[idx]
+		}
+		rows[i] = out
+	}
+	resp.Columns = append([]string(nil), fields...)
+	resp.Rows = rows
+	return resp, nil
+}
+
+// Boolean encodings accepted by BOOL_FORMAT.
+const (
+	boolLiteral = "literal" // true / false
+	boolNumeric = "numeric" // 1 / 0
+	boolChar    = "char"    // "t" / "f"
+)
+
+// boolFormatFromEnv returns the configured boolean encoding, defaulting to
+// JSON true/false.
+func boolFormatFromEnv() string {
+	switch v := os.Getenv("BOOL_FORMAT"); v {
+	case "", boolLiteral:
+		return boolLiteral
+	case boolNumeric, boolChar:
+		return v
+	default:
+		slog.Warn("unknown BOOL_FORMAT, using literal", "value", v)
+		return boolLiteral
+	}
+}
+
+// encodeBools returns rows with boolean values rewritten in the given
+// encoding. Rows are copied only when they hold a boolean; the input is
+// never modified.
+func encodeBools(rows [][]interface{}, style string) [][]interface{} {
+	if style == boolLiteral {
+		return rows
+	}
+	out := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		out[i] = row
+		copied := false
+		for j, v := range row {
+			b, ok := v.(bool)
+			if !ok {
+				continue
+			}
+			if !copied {
+				out[i] = append([]interface{}(nil), row...)
+				copied = true
+			}
+			out[i][j] = encodeBool(b, style)
+		}
+	}
+	return out
+}
+
+func encodeBool(b bool, style string) interface{} {
+	switch {
+	case style == boolNumeric && b:
+		return 1
+	case style == boolNumeric:
+		return 0
+	case b:
+		return "t"
+	default:
+		return "f"
+	}
+}
+
+// coerceString is the only value coercion a QueryRequest may ask for.
+const coerceString = "string"
+
+// validCoerce checks the coerce option of a QueryRequest.
+func validCoerce(mode string) error {
+	if mode == "" || mode == coerceString {
+		return nil
+	}
+	return fmt.Errorf("unsupported coerce %q (want %q)", mode, coerceString)
+}
+
+// stringifyValues returns rows with every non-NULL value rendered as a
+// string, so JavaScript clients never parse large integers into floats.
+// NULL stays null to keep it distinct from the text "null". The input is
+// never modified.
+func stringifyValues(rows [][]interface{}) [][]interface{} {
+	out := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		out[i] = make([]interface{}, len(row))
+		for j, v := range row {
+			switch v := v.(type) {
+			case nil:
+			case string:
+				out[i][j] = v
+			case float64:
+				out[i][j] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				out[i][j] = fmt.Sprint(v)
+			}
+		}
+	}
+	return out
+}
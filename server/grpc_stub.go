@@ -5,6 +5,10 @@ package main
 // startGRPCServer is a placeholder for a gRPC server exposing the same
 // Query service as the HTTP API. It is behind a build tag so that the
 // regular build does not require gRPC dependencies.
+//
+// The service is defined in proto/query.proto. Its Query handler must
+// convert the request message to a QueryRequest and call runQuery, so
+// limit, offset and timeout_ms behave exactly as they do over HTTP.
 func startGRPCServer(e *Engine) error {
 	return nil
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	hashRows   = "row"
+	hashResult = "result"
+)
+
+// validHashMode checks the hash option of a QueryRequest.
+func validHashMode(mode string) error {
+	switch mode {
+	case "", hashRows, hashResult:
+		return nil
+	}
+	return fmt.Errorf("unsupported hash %q (want %q or %q)", mode, hashRows, hashResult)
+}
+
+// hashRow is the hex SHA-256 of the row's compact JSON encoding, e.g.
+// [1,"Ada",null]. It is taken over the engine's values, so BOOL_FORMAT
+// and identifier quoting do not change it.
+func hashRow(row []interface{}) string {
+	data, _ := json.Marshal(row)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashResultSet is the hex SHA-256 of the compact JSON encoding of
+// [columns, rows], so both a changed value and a changed column list or
+// row order give a new hash.
+func hashResultSet(columns []string, rows [][]interface{}) string {
+	if rows == nil {
+		rows = [][]interface{}{}
+	}
+	data, _ := json.Marshal([]interface{}{columns, rows})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// addHashes fills the hash fields of resp requested by mode.
+func addHashes(resp *QueryResponse, mode string) {
+	switch mode {
+	case hashRows:
+		resp.RowHashes = make([]string, len(resp.Rows))
+		for i, row := range resp.Rows {
+			resp.RowHashes[i] = hashRow(row)
+		}
+	case hashResult:
+		resp.ResultHash = hashResultSet(resp.Columns, resp.Rows)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// extractHints strips a leading optimizer-style hint comment such as
+// "/*+ TIMEOUT(500) */" from sql and returns the remaining SQL and the
+// TIMEOUT value in milliseconds, or 0 if none was given. Unknown and
+// malformed hints are ignored, logged at debug level and described in the
+// returned warnings; SQL without a well-formed hint comment is returned
+// unchanged.
+func extractHints(sql string) (string, int, []string) {
+	body, ok := strings.CutPrefix(strings.TrimLeft(sql, " \t\r\n"), "/*+")
+	if !ok {
+		return sql, 0, nil
+	}
+	hints, rest, ok := strings.Cut(body, "*/")
+	if !ok {
+		slog.Debug("ignoring unterminated hint comment")
+		return sql, 0, []string{"ignoring unterminated hint comment"}
+	}
+	timeoutMS := 0
+	var warnings []string
+	ignore := func(kind, h string) {
+		slog.Debug("ignoring "+kind+" hint", "hint", h)
+		warnings = append(warnings, fmt.Sprintf("ignoring %s hint %s", kind, h))
+	}
+	for _, h := range strings.Fields(hints) {
+		name, arg, ok := strings.Cut(h, "(")
+		arg, closed := strings.CutSuffix(arg, ")")
+		if !ok || !closed || !strings.EqualFold(name, "TIMEOUT") {
+			ignore("unknown", h)
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			ignore("malformed", h)
+			continue
+		}
+		timeoutMS = n
+	}
+	return strings.TrimLeft(rest, " \t\r\n"), timeoutMS, warnings
+}
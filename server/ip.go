@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// parsePrefixes parses a comma-separated list of CIDR ranges. A bare
+// address is taken as a single-host range.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", s, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// prefixesFromEnv parses the CIDR list in the environment variable name.
+// A malformed list is logged and reported as not ok, so callers can fail
+// closed.
+func prefixesFromEnv(name string) (prefixes []netip.Prefix, ok bool) {
+	prefixes, err := parsePrefixes(os.Getenv(name))
+	if err != nil {
+		slog.Error("invalid "+name, "err", err)
+		return nil, false
+	}
+	return prefixes, true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent r. Forwarding
+// headers are only believed when the immediate peer is a trusted proxy:
+// X-Forwarded-For is then walked from the right, skipping trusted hops,
+// so the first untrusted address is the client and anything a client
+// prepended itself is never reached. Proxies that only send X-Real-IP
+// are honored when X-Forwarded-For is absent.
+func clientIP(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	peer = peer.Unmap()
+	if !containsAddr(trusted, peer) {
+		return peer, true
+	}
+	if len(r.Header.Values("X-Forwarded-For")) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return addr.Unmap(), true
+		}
+		return peer, true
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		hop = hop.Unmap()
+		if !containsAddr(trusted, hop) {
+			return hop, true
+		}
+		peer = hop
+	}
+	return peer, true
+}
+
+// allowClients wraps h so that, when ALLOWED_CIDRS is set, requests from
+// clients outside it are rejected with 403 before h runs. The client is
+// resolved with clientIP and TRUSTED_PROXIES, the same address that
+// appears in audit logs. Every route that runs queries is wrapped.
+func allowClients(h http.HandlerFunc) http.HandlerFunc {
+	if os.Getenv("ALLOWED_CIDRS") == "" {
+		return h
+	}
+	trustedProxies, _ := prefixesFromEnv("TRUSTED_PROXIES")
+	// A malformed allowlist leaves allowed empty, rejecting everyone
+	// rather than silently opening access.
+	allowed, _ := prefixesFromEnv("ALLOWED_CIDRS")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ip, ok := clientIP(r, trustedProxies); !ok || !containsAddr(allowed, ip) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		h(w, r)
+	}
+}
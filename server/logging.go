@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Log formats accepted by LOG_FORMAT.
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// logFormatFromEnv returns the configured log format. LOG_FORMAT selects
+// "json" or "text" explicitly; otherwise DEV_MODE gets human-readable text
+// and everything else structured JSON. ok is false when LOG_FORMAT holds
+// an unknown value and the default was used instead.
+func logFormatFromEnv() (format string, ok bool) {
+	def := logFormatJSON
+	if os.Getenv("DEV_MODE") == "1" {
+		def = logFormatText
+	}
+	switch v := os.Getenv("LOG_FORMAT"); v {
+	case "":
+		return def, true
+	case logFormatJSON, logFormatText:
+		return v, true
+	default:
+		return def, false
+	}
+}
+
+// newLogger builds the logger used for audit and request logs.
+func newLogger(format string, w io.Writer) *slog.Logger {
+	if format == logFormatText {
+		return slog.New(slog.NewTextHandler(w, nil))
+	}
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
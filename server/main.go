@@ -1,12 +1,20 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -18,12 +26,32 @@ type QueryRequest struct {
 	Limit     int    `json:"limit,omitempty"`
 	Offset    int    `json:"offset,omitempty"`
 	TimeoutMS int    `json:"timeout_ms,omitempty"`
+	// KeyBy returns rows as a JSON object keyed by this column's value
+	// instead of an array. Duplicate keys are rejected unless KeyLastWins
+	// is set.
+	KeyBy       string `json:"key_by,omitempty"`
+	KeyLastWins bool   `json:"key_last_wins,omitempty"`
+	// Hash adds content hashes to the response: "row" for one per row,
+	// "result" for a single hash of the whole result.
+	Hash string `json:"hash,omitempty"`
+	// Flags override server defaults for this request, for comparing
+	// behaviours in dev or staging. Only accepted in DEV_MODE.
+	Flags map[string]bool `json:"flags,omitempty"`
+	// PaginationMeta reports the total row count and next offset in the
+	// body, in X- headers, or both.
+	PaginationMeta string `json:"pagination_meta,omitempty"`
+	// Fields, when set, keeps only these result columns, in this order.
+	Fields []string `json:"fields,omitempty"`
+	// Coerce "string" renders every non-NULL value as a JSON string.
+	Coerce string `json:"coerce,omitempty"`
 }
 
 // APIError represents a structured error in the JSON contract.
 type APIError struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	// ID identifies a redacted error in the server log.
+	ID string `json:"id,omitempty"`
 }
 
 // QueryResponse is returned by the engine and always follows the
@@ -32,15 +60,96 @@ type QueryResponse struct {
 	Columns []string        `json:"columns,omitempty"`
 	Rows    [][]interface{} `json:"rows,omitempty"`
 	Error   *APIError       `json:"error,omitempty"`
+	// Truncated is set when rows were cut to the X-Max-Rows header.
+	Truncated bool `json:"truncated,omitempty"`
+	// RowHashes and ResultHash are set when the request asked for them.
+	RowHashes  []string `json:"row_hashes,omitempty"`
+	ResultHash string   `json:"result_hash,omitempty"`
+	// Warnings describe conditions worth surfacing that did not stop the
+	// query, such as an ignored hint or truncated rows.
+	Warnings   []string    `json:"warnings,omitempty"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+
+	// total is the row count before limit and offset were applied.
+	total int
+}
+
+// fullQueryResponse is the success body used when RESULT_FIELDS=always:
+// columns and rows are present even when empty, so clients can tell an
+// empty result set from a missing one.
+type fullQueryResponse struct {
+	Columns    []string        `json:"columns"`
+	Rows       [][]interface{} `json:"rows"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	RowHashes  []string        `json:"row_hashes,omitempty"`
+	ResultHash string          `json:"result_hash,omitempty"`
+	Warnings   []string        `json:"warnings,omitempty"`
+	Pagination *Pagination     `json:"pagination,omitempty"`
+}
+
+// withAllFields converts resp for RESULT_FIELDS=always, replacing nil
+// slices with empty ones so they encode as [] rather than null.
+func withAllFields(resp QueryResponse) fullQueryResponse {
+	full := fullQueryResponse{
+		Columns:    resp.Columns,
+		Rows:       resp.Rows,
+		Truncated:  resp.Truncated,
+		RowHashes:  resp.RowHashes,
+		ResultHash: resp.ResultHash,
+		Warnings:   resp.Warnings,
+		Pagination: resp.Pagination,
+	}
+	if full.Columns == nil {
+		full.Columns = []string{}
+	}
+	if full.Rows == nil {
+		full.Rows = [][]interface{}{}
+	}
+	return full
 }
 
+// DefaultQueryTimeout bounds queries whose caller did not supply a
+// deadline of its own.
+const DefaultQueryTimeout = 5 * time.Second
+
+// DefaultMaxColumns caps the number of columns in a single result unless
+// the engine is configured otherwise.
+const DefaultMaxColumns = 1000
+
+// ErrTooManyColumns is returned when a result would exceed the
+// configured column cap.
+var ErrTooManyColumns = errors.New("too many result columns")
+
+// ErrQueryTimeout is returned by Engine.Query when the query deadline
+// passes before execution finishes.
+var ErrQueryTimeout = errors.New("timeout")
+
 type Engine struct {
+	// table names the single table served by this engine.
+	table   string
 	columns []string
 	rows    [][]interface{}
+
+	// timeout applies to queries whose context carries no deadline.
+	// Zero means DefaultQueryTimeout.
+	timeout time.Duration
+	// maxColumns caps the width of a result. Zero means DefaultMaxColumns.
+	maxColumns int
+	// maxTimeout caps per-request timeouts from timeout_ms or a TIMEOUT
+	// hint. Zero means no cap.
+	maxTimeout time.Duration
+	// retries is how many times runQuery retries a transient error. Zero
+	// disables retrying.
+	retries int
+	// coalesce shares one execution between identical concurrent reads
+	// through flights. A request's "coalesce" flag overrides it.
+	coalesce bool
+	flights  flightGroup
 }
 
 func NewEngine() *Engine {
 	return &Engine{
+		table:   "users",
 		columns: []string{"id", "name"},
 		rows:    [][]interface{}{{1, "Alice"}},
 	}
@@ -49,12 +158,31 @@ func NewEngine() *Engine {
 // Query executes SQL with basic limit/offset handling.
 // If sql is empty an error is returned. A special SQL of "SLEEP"
 // simulates a slow query for timeout testing.
-func (e *Engine) Query(sql string, limit, offset int) (QueryResponse, error) {
+//
+// The deadline of ctx is honored by the engine itself so every entry
+// point (HTTP, gRPC, batch) shares the same enforcement. If ctx has no
+// deadline the engine's configured timeout is applied. ErrQueryTimeout
+// is returned once the deadline passes.
+func (e *Engine) Query(ctx context.Context, sql string, limit, offset int) (QueryResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := e.timeout
+		if timeout <= 0 {
+			timeout = DefaultQueryTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	if sql == "" {
 		return QueryResponse{}, errors.New("empty SQL")
 	}
 	if sql == "SLEEP" {
-		time.Sleep(200 * time.Millisecond)
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			return QueryResponse{}, contextError(ctx)
+		}
 	}
 	rows := e.rows
 	if offset > 0 {
@@ -67,68 +195,547 @@ func (e *Engine) Query(sql string, limit, offset int) (QueryResponse, error) {
 	if limit > 0 && limit < len(rows) {
 		rows = rows[:limit]
 	}
-	return QueryResponse{Columns: e.columns, Rows: rows}, nil
+	if ctx.Err() != nil {
+		return QueryResponse{}, contextError(ctx)
+	}
+	maxColumns := e.maxColumns
+	if maxColumns <= 0 {
+		maxColumns = DefaultMaxColumns
+	}
+	if len(e.columns) > maxColumns {
+		return QueryResponse{}, fmt.Errorf("%w: %d exceeds limit of %d", ErrTooManyColumns, len(e.columns), maxColumns)
+	}
+	return QueryResponse{Columns: e.columns, Rows: rows, total: len(e.rows)}, nil
+}
+
+// contextError maps a finished query context to the engine's error.
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrQueryTimeout
+	}
+	return ctx.Err()
+}
+
+// paginationFromURL fills req.Limit and req.Offset from the URL query
+// string when they were not provided in the JSON body.
+func paginationFromURL(r *http.Request, req *QueryRequest) error {
+	q := r.URL.Query()
+	if req.Limit == 0 {
+		n, err := queryInt(q.Get("limit"), "limit")
+		if err != nil {
+			return err
+		}
+		req.Limit = n
+	}
+	if req.Offset == 0 {
+		n, err := queryInt(q.Get("offset"), "offset")
+		if err != nil {
+			return err
+		}
+		req.Offset = n
+	}
+	return nil
+}
+
+// queryInt parses a non-negative integer query parameter. An empty
+// value yields zero.
+func queryInt(v, name string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, v)
+	}
+	return n, nil
+}
+
+// downloadFilename reports whether the client asked for the result as a
+// file download via ?download or ?download=<name>. The returned name is
+// restricted to a safe character set so it cannot break out of the
+// Content-Disposition header. def is used when no usable name is given.
+func downloadFilename(r *http.Request, def string) (string, bool) {
+	q := r.URL.Query()
+	if _, ok := q["download"]; !ok {
+		return "", false
+	}
+	v := q.Get("download")
+	switch v {
+	case "", "1", "true":
+		return def, true
+	}
+	name := make([]rune, 0, len(v))
+	for _, c := range v {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '.', c == '-', c == '_':
+			name = append(name, c)
+		}
+	}
+	if len(name) == 0 || strings.Trim(string(name), ".") == "" {
+		return def, true
+	}
+	return string(name), true
+}
+
+// maxRowsFromHeader returns the row cap a gateway set with X-Max-Rows.
+// Missing, non-numeric and non-positive values are ignored.
+func maxRowsFromHeader(r *http.Request) (int, bool) {
+	v := r.Header.Get("X-Max-Rows")
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		slog.Debug("ignoring invalid X-Max-Rows", "value", v)
+		return 0, false
+	}
+	return n, true
+}
+
+// runQuery executes req against e, applying its limit, offset and
+// timeout. A TIMEOUT hint at the start of the SQL acts like timeout_ms
+// when the request sets none, and both are clamped to the engine's
+// maximum. Every transport goes through here so HTTP and gRPC share the
+// same semantics.
+func runQuery(ctx context.Context, e *Engine, req QueryRequest) (QueryResponse, error) {
+	sql, hintMS, warnings := extractHints(req.SQL)
+	req.SQL = sql
+	switch {
+	case req.TimeoutMS <= 0:
+		req.TimeoutMS = hintMS
+	case hintMS > 0:
+		warnings = append(warnings, "TIMEOUT hint ignored: timeout_ms takes precedence")
+	}
+	if e.maxTimeout > 0 && time.Duration(req.TimeoutMS)*time.Millisecond > e.maxTimeout {
+		warnings = append(warnings, fmt.Sprintf("timeout of %dms capped to the server maximum of %dms", req.TimeoutMS, e.maxTimeout.Milliseconds()))
+		req.TimeoutMS = int(e.maxTimeout.Milliseconds())
+	}
+	if req.TimeoutMS > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.TimeoutMS)*time.Millisecond)
+		defer cancel()
+	}
+	execute := func() (QueryResponse, error) {
+		return withRetry(ctx, e.retries, DefaultRetryBackoff, func() (QueryResponse, error) {
+			return e.Query(ctx, req.SQL, req.Limit, req.Offset)
+		})
+	}
+	run := execute
+	coalesce := e.coalesce
+	if on, ok := req.Flags[flagCoalesce]; ok {
+		coalesce = on
+	}
+	if coalesce {
+		if key, ok := coalesceKey(req); ok {
+			run = func() (QueryResponse, error) { return e.flights.do(ctx, key, execute) }
+		}
+	}
+	resp, err := run()
+	if err == nil && len(warnings) > 0 {
+		resp.Warnings = append(warnings, resp.Warnings...)
+	}
+	return resp, err
 }
 
+// authorized checks the bearer token unless auth is disabled by dev mode
+// or an empty token.
+func authorized(r *http.Request, token string, devMode bool) bool {
+	if devMode || token == "" {
+		return true
+	}
+	return r.Header.Get("Authorization") == "Bearer "+token
+}
+
+// writeError sends a JSON error body following the QueryResponse schema.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(QueryResponse{Error: &APIError{Code: code, Message: message}})
+}
+
+// Error verbosity levels accepted by ERROR_VERBOSITY.
+const (
+	errorsFull    = "full"
+	errorsGeneric = "generic"
+)
+
+// verboseErrorsFromEnv reports whether clients see full engine error
+// messages. ERROR_VERBOSITY selects "full" or "generic" explicitly;
+// otherwise DEV_MODE gets full messages and everything else generic ones.
+func verboseErrorsFromEnv() bool {
+	switch v := os.Getenv("ERROR_VERBOSITY"); v {
+	case errorsFull:
+		return true
+	case errorsGeneric:
+		return false
+	case "":
+	default:
+		slog.Warn("unknown ERROR_VERBOSITY, using default", "value", v)
+	}
+	return os.Getenv("DEV_MODE") == "1"
+}
+
+// clientQueryError is the API error a client sees when sql fails with
+// err. Unless verbose, the detail is replaced by a generic message and a
+// random error id, and the full error and SQL are logged under the same
+// id so a client report can be matched to the log. Timeouts carry no
+// internal detail and are returned as is. Every endpoint that runs
+// queries reports their errors through here.
+func clientQueryError(err error, sql string, verbose bool) *APIError {
+	apiErr := queryAPIError(err)
+	if !verbose && apiErr.Code != http.StatusRequestTimeout {
+		var b [8]byte
+		rand.Read(b[:])
+		apiErr.ID = hex.EncodeToString(b[:])
+		apiErr.Message = "query failed"
+		slog.Error("query failed", "error_id", apiErr.ID, "sql", sql, "err", err)
+	}
+	return apiErr
+}
+
+// writeQueryError writes clientQueryError(err, sql, verbose) with its
+// HTTP status.
+func writeQueryError(w http.ResponseWriter, err error, sql string, verbose bool) {
+	apiErr := clientQueryError(err, sql, verbose)
+	w.WriteHeader(apiErr.Code)
+	json.NewEncoder(w).Encode(QueryResponse{Error: apiErr})
+}
+
+// DefaultSlowQuery is the duration past which a query is always logged,
+// regardless of sampling.
+const DefaultSlowQuery = time.Second
+
 func handleQuery(e *Engine) http.HandlerFunc {
 	token := os.Getenv("API_TOKEN")
 	devMode := os.Getenv("DEV_MODE") == "1"
+	sampler := &querySampler{rate: 1, slow: DefaultSlowQuery}
+	if n, err := strconv.Atoi(os.Getenv("LOG_SAMPLE_RATE")); err == nil && n > 0 {
+		sampler.rate = n
+	}
+	if ms, err := strconv.Atoi(os.Getenv("SLOW_QUERY_MS")); err == nil && ms > 0 {
+		sampler.slow = time.Duration(ms) * time.Millisecond
+	}
+	stats.logSampleRate.Store(int64(sampler.rate))
+	gzipLevel := gzipLevelFromEnv()
+	quoteStyle := identifierQuotingFromEnv()
+	allFields := os.Getenv("RESULT_FIELDS") == "always"
+	maxResponseBytes, _ := strconv.Atoi(os.Getenv("MAX_RESPONSE_BYTES"))
+	boolStyle := boolFormatFromEnv()
+	dupColumns := duplicateColumnsFromEnv()
+	flushEvery := flushPolicyFromEnv()
+	spill := spillConfigFromEnv()
+	defaultFormat, _ := defaultFormatFromEnv()
+	verboseErrors := verboseErrorsFromEnv()
+	trustedProxies, _ := prefixesFromEnv("TRUSTED_PROXIES")
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Authorization
-		if !devMode && token != "" {
-			auth := r.Header.Get("Authorization")
-			if auth != "Bearer "+token {
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(QueryResponse{Error: &APIError{Code: http.StatusUnauthorized, Message: "unauthorized"}})
-				return
-			}
+		if acceptsGzip(r) {
+			gz, _ := gzip.NewWriterLevel(w, gzipLevel)
+			defer gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+			w = &gzipResponseWriter{ResponseWriter: w, gz: gz}
+		}
+
+		ip, ipOK := clientIP(r, trustedProxies)
+		if !authorized(r, token, devMode) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
 		}
 
 		var req QueryRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(QueryResponse{Error: &APIError{Code: http.StatusBadRequest, Message: err.Error()}})
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 
-		// Audit log
-		log.Printf("query: %s", req.SQL)
+		// Pagination fallback: some gateways rewrite JSON bodies but keep
+		// the query string intact, so limit/offset may arrive in the URL.
+		// Values in the body take precedence.
+		if err := paginationFromURL(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-		timeout := time.Duration(req.TimeoutMS) * time.Millisecond
-		if timeout <= 0 {
-			timeout = 5 * time.Second
+		format, err := responseFormat(r, defaultFormat)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
 		}
-		ctx, cancel := context.WithTimeout(r.Context(), timeout)
-		defer cancel()
+		if req.KeyBy != "" && format != formatJSON {
+			writeError(w, http.StatusBadRequest, "key_by requires JSON output")
+			return
+		}
+		if err := checkFlags(req.Flags, devMode); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validHashMode(req.Hash); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validCoerce(req.Coerce); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := validPaginationMeta(req.PaginationMeta, format, req.KeyBy != ""); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Hash != "" && (format != formatJSON || req.KeyBy != "") {
+			writeError(w, http.StatusBadRequest, "hash requires plain JSON output")
+			return
+		}
+
+		start := time.Now()
+		stats.inFlight.Add(1)
+		resp, err := runQuery(r.Context(), e, req)
+		stats.inFlight.Add(-1)
+		elapsed := time.Since(start)
 
-		resultCh := make(chan QueryResponse, 1)
-		errCh := make(chan error, 1)
-		go func() {
-			resp, err := e.Query(req.SQL, req.Limit, req.Offset)
+		// Audit log
+		stats.queries.Add(1)
+		if err != nil {
+			stats.errors.Add(1)
+		}
+		if sampler.shouldLog(elapsed, err) {
+			attrs := []any{"sql", req.SQL, "duration_ms", elapsed.Milliseconds()}
+			if ipOK {
+				attrs = append(attrs, "client_ip", ip.String())
+			}
+			if len(req.Flags) > 0 {
+				attrs = append(attrs, "flags", req.Flags)
+			}
 			if err != nil {
-				errCh <- err
+				attrs = append(attrs, "err", err.Error())
+			}
+			slog.Info("query", attrs...)
+		}
+		failQuery := func(err error) {
+			writeQueryError(w, err, req.SQL, verboseErrors)
+		}
+		switch {
+		case err != nil:
+			failQuery(err)
+		default:
+			if req.Fields != nil {
+				if resp, err = selectFields(resp, req.Fields); err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			// X-Max-Rows bounds the result on top of any limit in the
+			// request, so the smaller of the two wins.
+			if n, ok := maxRowsFromHeader(r); ok && len(resp.Rows) > n {
+				resp.Rows = resp.Rows[:n]
+				resp.Truncated = true
+				resp.Warnings = append(resp.Warnings, fmt.Sprintf("result truncated to %d rows by X-Max-Rows", n))
+			}
+			addHashes(&resp, req.Hash)
+			var page *Pagination
+			if req.PaginationMeta != "" {
+				p := pagination(resp, req.Offset)
+				page = &p
+				if req.PaginationMeta != paginationHeaders {
+					resp.Pagination = page
+				}
+			}
+			objects := req.KeyBy != "" || format == formatColumnar
+			if resp.Columns, err = dedupeColumns(resp.Columns, dupColumns, objects); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			resp.Rows = encodeBools(resp.Rows, boolStyle)
+			if req.Coerce == coerceString {
+				resp.Rows = stringifyValues(resp.Rows)
+			}
+			var keyed map[string]map[string]interface{}
+			if req.KeyBy != "" {
+				names := quoteIdentifiers(resp.Columns, quoteStyle)
+				if keyed, err = keyedRows(resp, names, req.KeyBy, req.KeyLastWins); err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			resp.Columns = quoteIdentifiers(resp.Columns, quoteStyle)
+			setHeaders := func() {
+				w.Header().Set("Content-Type", formatContentTypes[format])
+				if page != nil && req.PaginationMeta != paginationBody {
+					setPaginationHeaders(w.Header(), *page)
+				}
+				if name, ok := downloadFilename(r, "result."+format); ok {
+					w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+				}
+				w.WriteHeader(http.StatusOK)
+			}
+			if format == formatCSV {
+				setHeaders()
+				if err := writeCSV(r.Context(), w, resp, maxResponseBytes, flushEvery); err != nil {
+					slog.Warn("csv stream aborted", "err", err)
+				}
 				return
 			}
-			resultCh <- resp
-		}()
 
-		select {
-		case <-ctx.Done():
-			w.WriteHeader(http.StatusRequestTimeout)
-			json.NewEncoder(w).Encode(QueryResponse{Error: &APIError{Code: http.StatusRequestTimeout, Message: "timeout"}})
-		case err := <-errCh:
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(QueryResponse{Error: &APIError{Code: http.StatusBadRequest, Message: err.Error()}})
-		case resp := <-resultCh:
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(resp)
+			// Row-array bodies are built by wrap, so that with spilling
+			// enabled their rows can be encoded one at a time.
+			var body interface{}
+			var wrap func(QueryResponse) interface{}
+			switch {
+			case format == formatColumnar:
+				body = columnar(resp)
+			case keyed != nil:
+				body = keyed
+			case allFields:
+				wrap = func(r QueryResponse) interface{} { return withAllFields(r) }
+			default:
+				wrap = func(r QueryResponse) interface{} { return r }
+			}
+			// JSON is buffered anyway by the encoder, so the size cap is
+			// enforced before any of it is sent: buf rejects the write that
+			// would cross it, which also stops encoding. With spilling
+			// enabled, a large body moves to a temp file instead of staying
+			// in memory.
+			buf := &spillBuffer{cfg: spill, limit: maxResponseBytes}
+			defer buf.Close()
+			if wrap != nil && spill.threshold > 0 {
+				err = encodeRowsJSON(buf, resp, wrap)
+			} else {
+				if wrap != nil {
+					body = wrap(resp)
+				}
+				err = json.NewEncoder(buf).Encode(body)
+			}
+			if err != nil {
+				failQuery(err)
+				return
+			}
+			setHeaders()
+			buf.WriteTo(w)
 		}
 	}
 }
 
 func main() {
+	format, ok := logFormatFromEnv()
+	// Installing the logger as the default also routes the standard log
+	// package through it, so every line shares one format.
+	slog.SetDefault(newLogger(format, os.Stderr))
+	if !ok {
+		slog.Warn("unknown LOG_FORMAT, using default", "value", os.Getenv("LOG_FORMAT"), "format", format)
+	}
+
+	if _, err := defaultFormatFromEnv(); err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
 	engine := NewEngine()
-	http.HandleFunc("/query", handleQuery(engine))
-	http.ListenAndServe(":8080", nil)
+	if ms, err := strconv.Atoi(os.Getenv("QUERY_TIMEOUT_MS")); err == nil && ms > 0 {
+		engine.timeout = time.Duration(ms) * time.Millisecond
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_RESULT_COLUMNS")); err == nil && n > 0 {
+		engine.maxColumns = n
+	}
+	if ms, err := strconv.Atoi(os.Getenv("MAX_QUERY_TIMEOUT_MS")); err == nil && ms > 0 {
+		engine.maxTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if n, err := strconv.Atoi(os.Getenv("QUERY_RETRIES")); err == nil && n > 0 {
+		engine.retries = min(n, MaxQueryRetries)
+	}
+	if os.Getenv("COALESCE_QUERIES") == "1" {
+		engine.coalesce = true
+	}
+	if path := os.Getenv("SELF_TEST_FILE"); path != "" {
+		cases, err := loadSelfTests(path)
+		if err == nil {
+			err = runSelfTests(context.Background(), engine, cases)
+		}
+		if err != nil {
+			slog.Error("startup self-test failed", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("startup self-test passed", "queries", len(cases))
+	}
+	http.HandleFunc("/query", allowClients(handleQuery(engine)))
+	http.HandleFunc("/diff", allowClients(handleDiff(engine)))
+	http.HandleFunc("/script", allowClients(handleScript(engine)))
+	http.HandleFunc("/profile", allowClients(handleProfile(engine)))
+	http.HandleFunc("/export", allowClients(handleExport(engine)))
+	http.HandleFunc("/stats", handleStats())
+	http.HandleFunc("/capabilities", handleCapabilities(engine))
+	http.HandleFunc("/examples", handleExamples(engine))
+	if os.Getenv("REPL_WEBSOCKET") == "1" {
+		http.HandleFunc("/repl", allowClients(handleREPL(engine)))
+	}
+	if path := os.Getenv("QUERY_TEMPLATES"); path != "" {
+		templates, err := loadTemplates(path)
+		if err != nil {
+			slog.Error("loading query templates", "err", err)
+			os.Exit(1)
+		}
+		http.HandleFunc("/run/", allowClients(handleRun(engine, templates)))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: ":8080"}
+	configureServer(srv)
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	go func() {
+		var err error
+		if certFile != "" && keyFile != "" {
+			// net/http negotiates HTTP/2 automatically over TLS.
+			err = srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	shutdown(srv, shutdownTimeoutFromEnv())
+}
+
+// DefaultShutdownTimeout bounds how long shutdown waits for in-flight
+// queries to finish.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeoutFromEnv returns the drain window configured with
+// SHUTDOWN_TIMEOUT_MS.
+func shutdownTimeoutFromEnv() time.Duration {
+	if ms, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT_MS")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return DefaultShutdownTimeout
+}
+
+// configureServer applies connection settings from the environment:
+// HTTP_IDLE_TIMEOUT_MS bounds how long an idle keep-alive connection is
+// kept open, and HTTP_KEEPALIVE=0 closes connections after each response.
+func configureServer(srv *http.Server) {
+	if ms, err := strconv.Atoi(os.Getenv("HTTP_IDLE_TIMEOUT_MS")); err == nil && ms > 0 {
+		srv.IdleTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if os.Getenv("HTTP_KEEPALIVE") == "0" {
+		srv.SetKeepAlivesEnabled(false)
+	}
+}
+
+// shutdown stops accepting connections and waits up to timeout for
+// in-flight requests. Connections still open after the drain window are
+// closed forcibly.
+func shutdown(srv *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	slog.Info("shutting down", "drain_timeout_ms", timeout.Milliseconds())
+	err := srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("drain timeout reached, closing connections", "in_flight", stats.inFlight.Load())
+		srv.Close()
+	}
+	return err
 }
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestHandleQuery(t *testing.T) {
@@ -60,3 +75,1985 @@ func TestHandleQueryTimeout(t *testing.T) {
 		t.Fatalf("expected 408, got %d", w.Code)
 	}
 }
+
+func TestHandleQueryPaginationFromURL(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		columns: []string{"id"},
+		rows:    [][]interface{}{{1}, {2}, {3}},
+	}
+
+	body := []byte(`{"sql":"SELECT * FROM users"}`)
+	req := httptest.NewRequest("POST", "/query?limit=1&offset=1", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleQuery(e)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp QueryResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if len(resp.Rows) != 1 || resp.Rows[0][0] != float64(2) {
+		t.Fatalf("expected row [2], got %v", resp.Rows)
+	}
+
+	// Body values win over the query string.
+	body = []byte(`{"sql":"SELECT * FROM users","limit":2}`)
+	req = httptest.NewRequest("POST", "/query?limit=1", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	handleQuery(e)(w, req)
+
+	resp = QueryResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if len(resp.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(resp.Rows))
+	}
+}
+
+func TestHandleQueryInvalidURLPagination(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	body := []byte(`{"sql":"SELECT * FROM users"}`)
+	req := httptest.NewRequest("POST", "/query?limit=abc", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleQuery(NewEngine())(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestHandleQueryDownload(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	cases := map[string]string{
+		"/query":                             "",
+		"/query?download":                    `attachment; filename="result.json"`,
+		"/query?download=users.json":         `attachment; filename="users.json"`,
+		"/query?download=a%22%0d%0aX-Evil:1": `attachment; filename="aX-Evil1"`,
+	}
+	for target, want := range cases {
+		body := []byte(`{"sql":"SELECT * FROM users"}`)
+		req := httptest.NewRequest("POST", target, bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		handleQuery(NewEngine())(w, req)
+
+		if got := w.Header().Get("Content-Disposition"); got != want {
+			t.Errorf("%s: expected Content-Disposition %q, got %q", target, want, got)
+		}
+	}
+}
+
+func TestEngineQueryDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := NewEngine().Query(ctx, "SLEEP", 0, 0); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("expected ErrQueryTimeout, got %v", err)
+	}
+}
+
+func TestEngineQueryDefaultTimeout(t *testing.T) {
+	e := NewEngine()
+	e.timeout = 10 * time.Millisecond
+
+	if _, err := e.Query(context.Background(), "SLEEP", 0, 0); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("expected ErrQueryTimeout, got %v", err)
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	if f, _ := logFormatFromEnv(); f != logFormatText {
+		t.Fatalf("expected text in dev mode, got %s", f)
+	}
+	os.Unsetenv("DEV_MODE")
+	if f, _ := logFormatFromEnv(); f != logFormatJSON {
+		t.Fatalf("expected json by default, got %s", f)
+	}
+	os.Setenv("LOG_FORMAT", "xml")
+	defer os.Unsetenv("LOG_FORMAT")
+	if f, ok := logFormatFromEnv(); ok || f != logFormatJSON {
+		t.Fatalf("expected fallback to json for invalid format, got %s ok=%v", f, ok)
+	}
+
+	var buf bytes.Buffer
+	newLogger(logFormatJSON, &buf).Info("query", "sql", "SELECT 1")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("json log line: %v", err)
+	}
+	if entry["sql"] != "SELECT 1" {
+		t.Fatalf("unexpected log entry %v", entry)
+	}
+
+	buf.Reset()
+	newLogger(logFormatText, &buf).Info("query", "sql", "SELECT 1")
+	if !bytes.Contains(buf.Bytes(), []byte(`sql="SELECT 1"`)) {
+		t.Fatalf("unexpected text log line %q", buf.String())
+	}
+}
+
+func TestHandleQueryCSV(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "Alice"}, {2, nil}},
+	}
+	for _, setup := range []func(*http.Request){
+		func(r *http.Request) { r.URL.RawQuery = "format=csv" },
+		func(r *http.Request) { r.Header.Set("Accept", "text/csv") },
+	} {
+		body := []byte(`{"sql":"SELECT * FROM users"}`)
+		req := httptest.NewRequest("POST", "/query", bytes.NewReader(body))
+		setup(req)
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+			t.Fatalf("expected text/csv, got %q", ct)
+		}
+		if got, want := w.Body.String(), "id,name\n1,Alice\n2,\n"; got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestHandleQueryUnsupportedFormat(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	body := []byte(`{"sql":"SELECT * FROM users"}`)
+	req := httptest.NewRequest("POST", "/query?format=xml", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleQuery(NewEngine())(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestWriteCSVCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	resp := QueryResponse{Columns: []string{"id"}, Rows: [][]interface{}{{1}, {2}}}
+	if err := writeCSV(ctx, w, resp, 0, flushEveryRow); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if got := w.Body.String(); got != "id\n" {
+		t.Fatalf("expected only the header row, got %q", got)
+	}
+}
+
+// flushCounter is a ResponseRecorder that counts flushes.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushCounter) Flush() { f.flushes++ }
+
+func TestStreamFlushPolicy(t *testing.T) {
+	resp := QueryResponse{Columns: []string{"id"}}
+	for i := 0; i < 10; i++ {
+		resp.Rows = append(resp.Rows, []interface{}{i})
+	}
+	cases := []struct {
+		policy flushPolicy
+		csv    int // header flush plus row flushes
+		ndjson int
+	}{
+		{flushEveryRow, 11, 10},
+		{flushPolicy{rows: 4}, 3, 2},
+		{flushPolicy{interval: time.Hour}, 1, 0},
+	}
+	for _, c := range cases {
+		w := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+		if err := writeCSV(context.Background(), w, resp, 0, c.policy); err != nil {
+			t.Fatal(err)
+		}
+		if w.flushes != c.csv {
+			t.Fatalf("%+v: expected %d csv flushes, got %d", c.policy, c.csv, w.flushes)
+		}
+		w = &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+		if err := writeNDJSON(context.Background(), w, resp, c.policy); err != nil {
+			t.Fatal(err)
+		}
+		if w.flushes != c.ndjson || strings.Count(w.Body.String(), "\n") != 10 {
+			t.Fatalf("%+v: expected %d ndjson flushes and 10 lines, got %d flushes", c.policy, c.ndjson, w.flushes)
+		}
+	}
+
+	os.Setenv("STREAM_FLUSH_MS", "50")
+	defer os.Unsetenv("STREAM_FLUSH_MS")
+	if got := flushPolicyFromEnv(); got != (flushPolicy{interval: 50 * time.Millisecond}) {
+		t.Fatalf("unexpected policy %+v", got)
+	}
+}
+
+func TestEngineQueryMaxColumns(t *testing.T) {
+	e := NewEngine()
+	e.maxColumns = 1
+
+	if _, err := e.Query(context.Background(), "SELECT * FROM users", 0, 0); !errors.Is(err, ErrTooManyColumns) {
+		t.Fatalf("expected ErrTooManyColumns, got %v", err)
+	}
+
+	e.maxColumns = 2
+	if _, err := e.Query(context.Background(), "SELECT * FROM users", 0, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestQuerySampler(t *testing.T) {
+	s := &querySampler{rate: 3, slow: time.Second}
+
+	logged := 0
+	for i := 0; i < 9; i++ {
+		if s.shouldLog(time.Millisecond, nil) {
+			logged++
+		}
+	}
+	if logged != 3 {
+		t.Fatalf("expected 3 of 9 queries logged, got %d", logged)
+	}
+	if !s.shouldLog(time.Millisecond, errors.New("boom")) {
+		t.Fatal("errors must bypass sampling")
+	}
+	if !s.shouldLog(2*time.Second, nil) {
+		t.Fatal("slow queries must bypass sampling")
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	os.Setenv("LOG_SAMPLE_RATE", "10")
+	defer os.Unsetenv("LOG_SAMPLE_RATE")
+	handleQuery(NewEngine())
+
+	w := httptest.NewRecorder()
+	handleStats()(w, httptest.NewRequest("GET", "/stats", nil))
+
+	var resp StatsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if resp.LogSampleRate != 10 {
+		t.Fatalf("expected log_sample_rate 10, got %d", resp.LogSampleRate)
+	}
+}
+
+func TestHandleQueryGzip(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("GZIP_LEVEL", "1")
+	defer os.Unsetenv("GZIP_LEVEL")
+
+	body := []byte(`{"sql":"SELECT * FROM users"}`)
+	req := httptest.NewRequest("POST", "/query", bytes.NewReader(body))
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handleQuery(NewEngine())(w, req)
+
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("expected gzip encoding, got %q", ce)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	var resp QueryResponse
+	if err := json.NewDecoder(zr).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if len(resp.Rows) != 1 {
+		t.Fatalf("expected 1 row, got %d", len(resp.Rows))
+	}
+}
+
+func TestGzipLevelFromEnv(t *testing.T) {
+	defer os.Unsetenv("GZIP_LEVEL")
+	for v, want := range map[string]int{
+		"":    gzip.DefaultCompression,
+		"1":   gzip.BestSpeed,
+		"9":   gzip.BestCompression,
+		"42":  gzip.DefaultCompression,
+		"abc": gzip.DefaultCompression,
+	} {
+		os.Setenv("GZIP_LEVEL", v)
+		if got := gzipLevelFromEnv(); got != want {
+			t.Errorf("GZIP_LEVEL=%q: expected %d, got %d", v, want, got)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"gzip;q=0":          false,
+		"br":                false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(r); got != want {
+			t.Errorf("%q: expected %v, got %v", header, want, got)
+		}
+	}
+}
+
+func TestHandleDiff(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "Alice"}, {2, "Bobby"}, {4, "Dan"}},
+	}
+	body := []byte(`{"sql":"SELECT * FROM users","key":["id"],
+		"previous":[[1,"Alice"],[2,"Bob"],[3,"Carol"]]}`)
+	req := httptest.NewRequest("POST", "/diff", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleDiff(e)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp DiffResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	check := func(name string, got [][]interface{}, wantID float64) {
+		if len(got) != 1 || got[0][0] != wantID {
+			t.Errorf("%s: expected row with id %v, got %v", name, wantID, got)
+		}
+	}
+	check("added", resp.Added, 4)
+	check("removed", resp.Removed, 3)
+	check("changed", resp.Changed, 2)
+}
+
+func TestHandleDiffUnknownKey(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	body := []byte(`{"sql":"SELECT * FROM users","base_sql":"SELECT * FROM users","key":["nope"]}`)
+	req := httptest.NewRequest("POST", "/diff", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleDiff(NewEngine())(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestQuoteIdentifiers(t *testing.T) {
+	cols := []string{"users.id", `we"ird`, "back`tick"}
+	cases := map[string][]string{
+		quoteNone:     {"users.id", `we"ird`, "back`tick"},
+		quoteDouble:   {`"users.id"`, `"we""ird"`, "\"back`tick\""},
+		quoteBacktick: {"`users.id`", "`we\"ird`", "`back``tick`"},
+	}
+	for style, want := range cases {
+		got := quoteIdentifiers(cols, style)
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: expected %q, got %q", style, want[i], got[i])
+			}
+		}
+	}
+	if cols[0] != "users.id" {
+		t.Fatal("input columns were modified")
+	}
+}
+
+func TestHandleQueryIdentifierQuoting(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("IDENTIFIER_QUOTING", "double")
+	defer os.Unsetenv("IDENTIFIER_QUOTING")
+
+	body := []byte(`{"sql":"SELECT * FROM users"}`)
+	req := httptest.NewRequest("POST", "/query", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	e := NewEngine()
+	handleQuery(e)(w, req)
+
+	var resp QueryResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if resp.Columns[0] != `"id"` {
+		t.Fatalf("expected quoted column, got %q", resp.Columns[0])
+	}
+	if e.columns[0] != "id" {
+		t.Fatal("engine schema was modified")
+	}
+}
+
+func TestHandleQueryResultFieldsAlways(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("RESULT_FIELDS", "always")
+	defer os.Unsetenv("RESULT_FIELDS")
+
+	body := []byte(`{"sql":"SELECT * FROM users","offset":100}`)
+	req := httptest.NewRequest("POST", "/query", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	handleQuery(NewEngine())(w, req)
+
+	want := `{"columns":["id","name"],"rows":[]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestHandleProfile(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "Alice"}, {5, nil}, {3, "Alice"}},
+	}
+	w := httptest.NewRecorder()
+	handleProfile(e)(w, httptest.NewRequest("GET", "/profile?table=users", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp ProfileResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	id, name := resp.Columns[0], resp.Columns[1]
+	if id.Distinct != 3 || *id.Min != 1 || *id.Max != 5 || id.NullCount != 0 {
+		t.Errorf("unexpected id profile %+v", id)
+	}
+	if name.Distinct != 1 || name.NullCount != 1 || name.Min != nil {
+		t.Errorf("unexpected name profile %+v", name)
+	}
+
+	w = httptest.NewRecorder()
+	handleProfile(e)(w, httptest.NewRequest("GET", "/profile?table=orders", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+}
+
+func TestProfileApproxDistinct(t *testing.T) {
+	e := &Engine{table: "t", columns: []string{"n"}}
+	for i := 0; i < 5000; i++ {
+		e.rows = append(e.rows, []interface{}{i % 2000})
+	}
+	resp, err := e.Profile(context.Background(), "t", true)
+	if err != nil {
+		t.Fatalf("profile: %v", err)
+	}
+	if got := resp.Columns[0].Distinct; got < 1800 || got > 2200 {
+		t.Fatalf("expected about 2000 distinct values, got %d", got)
+	}
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	go http.Get("http://" + ln.Addr().String())
+	<-started
+
+	if err := shutdown(srv, 20*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected drain timeout, got %v", err)
+	}
+}
+
+func TestShutdownTimeoutFromEnv(t *testing.T) {
+	if got := shutdownTimeoutFromEnv(); got != DefaultShutdownTimeout {
+		t.Fatalf("expected default, got %v", got)
+	}
+	os.Setenv("SHUTDOWN_TIMEOUT_MS", "1500")
+	defer os.Unsetenv("SHUTDOWN_TIMEOUT_MS")
+	if got := shutdownTimeoutFromEnv(); got != 1500*time.Millisecond {
+		t.Fatalf("expected 1.5s, got %v", got)
+	}
+}
+
+func TestTemplateBind(t *testing.T) {
+	tmpl, err := parseTemplate("SELECT * FROM users WHERE name = :name AND note = ':skip' LIMIT :n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tmpl.bind(map[string]interface{}{"name": "O'Brien", "n": json.Number("10")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SELECT * FROM users WHERE name = 'O''Brien' AND note = ':skip' LIMIT 10"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if _, err := tmpl.bind(map[string]interface{}{"name": "x"}, nil); err == nil {
+		t.Fatal("expected error for missing param")
+	}
+	if _, err := tmpl.bind(map[string]interface{}{"name": "x", "n": json.Number("1"), "extra": json.Number("1")}, nil); err == nil {
+		t.Fatal("expected error for unknown param")
+	}
+
+	// Values the engine's grammar can read back: NULL and negative ints.
+	where, err := parseTemplate("SELECT * FROM t WHERE a = ? AND b = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := where.bind(nil, []interface{}{nil, json.Number("-3")}); err != nil || got != "SELECT * FROM t WHERE a = NULL AND b = -3" {
+		t.Fatalf("unexpected bind %q, %v", got, err)
+	}
+	// Integers past 2^53 are bound exactly.
+	if got, err := where.bind(nil, []interface{}{json.Number("9007199254740993"), json.Number("-9223372036854775808")}); err != nil || got != "SELECT * FROM t WHERE a = 9007199254740993 AND b = -9223372036854775808" {
+		t.Fatalf("unexpected bind %q, %v", got, err)
+	}
+	for _, bad := range []interface{}{json.Number("2.5"), json.Number("1e19"), json.Number("1.0"), json.Number("9223372036854775808"), 2.0, []interface{}{}} {
+		if _, err := where.bind(nil, []interface{}{bad, json.Number("1")}); err == nil {
+			t.Fatalf("expected error binding %v", bad)
+		}
+	}
+}
+
+func TestTemplateBindLimitOffset(t *testing.T) {
+	named, err := parseTemplate("SELECT * FROM users LIMIT :n OFFSET :skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := named.bind(map[string]interface{}{"n": json.Number("5"), "skip": json.Number("10")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SELECT * FROM users LIMIT 5 OFFSET 10"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	positional, err := parseTemplate("SELECT * FROM users WHERE name = ? AND note = '?' limit ? offset ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = positional.bind(nil, []interface{}{"ann", json.Number("2"), json.Number("0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "SELECT * FROM users WHERE name = 'ann' AND note = '?' limit 2 offset 0"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	for _, bad := range []interface{}{"5", json.Number("2.5"), json.Number("-1"), 2.0, nil, true} {
+		if _, err := positional.bind(nil, []interface{}{"ann", bad, json.Number("0")}); err == nil {
+			t.Fatalf("expected error binding %v to LIMIT", bad)
+		}
+		if _, err := named.bind(map[string]interface{}{"n": json.Number("1"), "skip": bad}, nil); err == nil {
+			t.Fatalf("expected error binding %v to OFFSET", bad)
+		}
+	}
+	if _, err := positional.bind(nil, []interface{}{"ann", json.Number("2")}); err == nil {
+		t.Fatal("expected error for missing arg")
+	}
+	if _, err := positional.bind(nil, []interface{}{"ann", json.Number("2"), json.Number("0"), json.Number("1")}); err == nil {
+		t.Fatal("expected error for extra arg")
+	}
+	if _, err := parseTemplate("SELECT * FROM users WHERE name = :name LIMIT ?"); err == nil {
+		t.Fatal("expected error mixing named and positional placeholders")
+	}
+}
+
+func TestLoadTemplatesValidates(t *testing.T) {
+	dir := t.TempDir()
+	bad := dir + "/bad.json"
+	os.WriteFile(bad, []byte(`{"top_users":"SELECT * FROM users WHERE name = 'open"}`), 0o600)
+	if _, err := loadTemplates(bad); err == nil {
+		t.Fatal("expected error for unterminated literal")
+	}
+	good := dir + "/good.json"
+	os.WriteFile(good, []byte(`{"top_users":"SELECT * FROM users LIMIT :n"}`), 0o600)
+	templates, err := loadTemplates(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	h := handleRun(NewEngine(), templates)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/run/top_users", strings.NewReader(`{"params":{"n":5}}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/run/top_users", strings.NewReader(`{"params":{"n":5.5}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a fractional LIMIT, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/run/missing", strings.NewReader(`{}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/run/top_users", strings.NewReader(`{}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+func TestHandleQueryMaxRowsHeader(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id"},
+		rows:    [][]interface{}{{1}, {2}, {3}, {4}},
+	}
+	cases := []struct {
+		header    string
+		body      string
+		rows      int
+		truncated bool
+	}{
+		{"2", `{"sql":"SELECT * FROM users"}`, 2, true},
+		{"3", `{"sql":"SELECT * FROM users","limit":1}`, 1, false},
+		{"10", `{"sql":"SELECT * FROM users"}`, 4, false},
+		{"bogus", `{"sql":"SELECT * FROM users"}`, 4, false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/query", strings.NewReader(c.body))
+		req.Header.Set("X-Max-Rows", c.header)
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, req)
+
+		var resp QueryResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		if len(resp.Rows) != c.rows || resp.Truncated != c.truncated {
+			t.Fatalf("X-Max-Rows %s: got %d rows, truncated=%v", c.header, len(resp.Rows), resp.Truncated)
+		}
+	}
+}
+
+func TestHandleQueryKeyBy(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "Alice"}, {2, "Bob"}, {1, "Carol"}},
+	}
+	run := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+		return w
+	}
+
+	w := run(`{"sql":"SELECT * FROM users","limit":2,"key_by":"id"}`)
+	want := `{"1":{"id":1,"name":"Alice"},"2":{"id":2,"name":"Bob"}}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if w := run(`{"sql":"SELECT * FROM users","key_by":"id"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for duplicate key, got %d", w.Code)
+	}
+	w = run(`{"sql":"SELECT * FROM users","key_by":"id","key_last_wins":true}`)
+	var keyed map[string]map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&keyed); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if keyed["1"]["name"] != "Carol" {
+		t.Fatalf("expected last row to win, got %v", keyed["1"])
+	}
+	if w := run(`{"sql":"SELECT * FROM users","key_by":"nope"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown key column, got %d", w.Code)
+	}
+}
+
+func TestHandleQueryFields(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name", "email"},
+		rows:    [][]interface{}{{1, "Alice", "a@x"}, {2, "Bob", "b@x"}},
+	}
+	run := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+		return w
+	}
+
+	w := run(`{"sql":"SELECT * FROM users","fields":["email","id"]}`)
+	want := `{"columns":["email","id"],"rows":[["a@x",1],["b@x",2]]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if w := run(`{"sql":"SELECT * FROM users","fields":["id","nope"]}`); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `\"nope\"`) {
+		t.Fatalf("expected 400 naming the unknown field, got %d %s", w.Code, w.Body.String())
+	}
+	if w := run(`{"sql":"SELECT * FROM users","fields":["id","id"]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a repeated field, got %d", w.Code)
+	}
+	if e.rows[0][1] != "Alice" {
+		t.Fatalf("engine rows modified: %v", e.rows[0])
+	}
+}
+
+func TestDuplicateColumns(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	defer os.Unsetenv("DUPLICATE_COLUMNS")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name", "id"},
+		rows:    [][]interface{}{{1, "Alice", 10}},
+	}
+	cases := []struct {
+		policy, url, body string
+		code              int
+		want              string
+	}{
+		{"", "/query", `{"sql":"SELECT id, name, id FROM users"}`, 200,
+			`{"columns":["id","name","id"],"rows":[[1,"Alice",10]]}`},
+		{"", "/query", `{"sql":"SELECT id, name, id FROM users","key_by":"id"}`, 200,
+			`{"1":{"id":1,"id_1":10,"name":"Alice"}}`},
+		{"", "/query?format=columnar", `{"sql":"SELECT id, name, id FROM users"}`, 200,
+			`{"columns":["id","name","id_1"],"data":{"id":[1],"id_1":[10],"name":["Alice"]}}`},
+		{"suffix", "/query", `{"sql":"SELECT id, name, id FROM users"}`, 200,
+			`{"columns":["id","name","id_1"],"rows":[[1,"Alice",10]]}`},
+		{"keep", "/query", `{"sql":"SELECT id, name, id FROM users"}`, 200,
+			`{"columns":["id","name","id"],"rows":[[1,"Alice",10]]}`},
+		{"keep", "/query", `{"sql":"SELECT id, name, id FROM users","key_by":"name"}`, 400, ""},
+		{"keep", "/query?format=columnar", `{"sql":"SELECT id, name, id FROM users"}`, 400, ""},
+		{"error", "/query", `{"sql":"SELECT id, name, id FROM users"}`, 400, ""},
+		{"error", "/query?format=csv", `{"sql":"SELECT id, name, id FROM users"}`, 400, ""},
+	}
+	for _, c := range cases {
+		os.Setenv("DUPLICATE_COLUMNS", c.policy)
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", c.url, strings.NewReader(c.body)))
+		if w.Code != c.code {
+			t.Fatalf("%q %s %s: expected %d, got %d: %s", c.policy, c.url, c.body, c.code, w.Code, w.Body.String())
+		}
+		if got := strings.TrimSpace(w.Body.String()); c.want != "" && got != c.want {
+			t.Fatalf("%q %s %s: expected %s, got %s", c.policy, c.url, c.body, c.want, got)
+		}
+	}
+
+	// A suffix never collides with a column already in the result.
+	got, _ := dedupeColumns([]string{"id", "id", "id_1"}, dupSuffix, false)
+	if strings.Join(got, ",") != "id,id_2,id_1" {
+		t.Fatalf("expected id,id_2,id_1, got %v", got)
+	}
+	if e.columns[2] != "id" {
+		t.Fatal("engine columns were modified")
+	}
+}
+
+func TestServerNegotiatesHTTP2OverTLS(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("HTTP_IDLE_TIMEOUT_MS", "1500")
+	defer os.Unsetenv("HTTP_IDLE_TIMEOUT_MS")
+
+	ts := httptest.NewUnstartedServer(handleQuery(NewEngine()))
+	configureServer(ts.Config)
+	if ts.Config.IdleTimeout != 1500*time.Millisecond {
+		t.Fatalf("expected idle timeout 1.5s, got %v", ts.Config.IdleTimeout)
+	}
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	// CSV is streamed with a flush per row, so this also exercises
+	// streaming over h2.
+	resp, err := ts.Client().Post(ts.URL+"?format=csv", "application/json", strings.NewReader(`{"sql":"SELECT * FROM users"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	if want := "id,name\n1,Alice\n"; body.String() != want {
+		t.Fatalf("expected %q, got %q", want, body.String())
+	}
+}
+
+func TestHandleExamplesDevOnly(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleExamples(NewEngine())(w, httptest.NewRequest("GET", "/examples", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 outside dev mode, got %d", w.Code)
+	}
+
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	w = httptest.NewRecorder()
+	handleExamples(NewEngine())(w, httptest.NewRequest("GET", "/examples", nil))
+	var resp ExamplesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if len(resp.Queries) == 0 || resp.Queries[1] != "SELECT id, name FROM users" {
+		t.Fatalf("unexpected examples %q", resp.Queries)
+	}
+}
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	var g flightGroup
+	before := stats.coalesced.Load()
+	var calls atomic.Int64
+	release := make(chan struct{})
+	slow := func() (QueryResponse, error) {
+		calls.Add(1)
+		<-release
+		return QueryResponse{Columns: []string{"id"}}, nil
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	results := make(chan QueryResponse, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := g.do(context.Background(), "k", slow)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- resp
+		}()
+	}
+	for deadline := time.Now().Add(time.Second); stats.coalesced.Load()-before < n-1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d callers joined", stats.coalesced.Load()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+	if calls.Load() != 1 {
+		t.Fatalf("expected 1 execution, got %d", calls.Load())
+	}
+	for resp := range results {
+		if len(resp.Columns) != 1 {
+			t.Fatalf("caller got %+v", resp)
+		}
+	}
+
+	// Failures are not shared, and nothing outlives the flight.
+	fail := func() (QueryResponse, error) { return QueryResponse{}, errors.New("boom") }
+	if _, err := g.do(context.Background(), "k", fail); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := g.do(context.Background(), "k", func() (QueryResponse, error) { return QueryResponse{}, nil }); err != nil {
+		t.Fatalf("later call reused a finished flight: %v", err)
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	if err := checkFlags(map[string]bool{"coalesce": true}, false); err == nil {
+		t.Fatal("expected flags to be rejected outside dev mode")
+	}
+	if err := checkFlags(map[string]bool{"new_planner": true}, true); err == nil {
+		t.Fatal("expected error for unknown flag")
+	}
+
+	// Park a finished flight under the request's key: only a coalesced
+	// request returns its result instead of executing.
+	e := NewEngine()
+	req := QueryRequest{SQL: "SELECT * FROM users"}
+	key, _ := coalesceKey(req)
+	parked := &flight{done: make(chan struct{}), resp: QueryResponse{Columns: []string{"parked"}}}
+	close(parked.done)
+	e.flights.flights = map[string]*flight{key: parked}
+
+	resp, _ := runQuery(context.Background(), e, req)
+	if resp.Columns[0] != "id" {
+		t.Fatalf("expected normal execution without the flag, got %v", resp.Columns)
+	}
+	req.Flags = map[string]bool{"coalesce": true}
+	if resp, _ = runQuery(context.Background(), e, req); resp.Columns[0] != "parked" {
+		t.Fatalf("expected coalesce flag to join the flight, got %v", resp.Columns)
+	}
+	e.coalesce = true
+	req.Flags = map[string]bool{"coalesce": false}
+	if resp, _ = runQuery(context.Background(), e, req); resp.Columns[0] != "id" {
+		t.Fatalf("expected coalesce=false to override the default, got %v", resp.Columns)
+	}
+	delete(e.flights.flights, key)
+	req.Flags = nil
+	if resp, _ = runQuery(context.Background(), e, req); resp.Columns[0] != "id" {
+		t.Fatalf("expected a coalesced query to execute, got %v", resp.Columns)
+	}
+
+	w := httptest.NewRecorder()
+	handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT * FROM users","flags":{"coalesce":true}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 outside dev mode, got %d", w.Code)
+	}
+}
+
+func TestQueryStopsOnClientDisconnect(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	done := make(chan time.Duration, 1)
+	h := handleQuery(NewEngine())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		done <- time.Since(start)
+	}))
+	defer srv.Close()
+
+	// SLEEP takes 200ms; the client gives up after 20ms.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", srv.URL, strings.NewReader(`{"sql":"SLEEP","timeout_ms":5000}`))
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("expected the client request to be cancelled")
+	}
+	select {
+	case elapsed := <-done:
+		if elapsed >= 150*time.Millisecond {
+			t.Fatalf("handler ran for %v after the client left", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not return")
+	}
+
+	// A caller waiting on another request's flight stops waiting too.
+	var g flightGroup
+	release := make(chan struct{})
+	defer close(release)
+	go g.do(context.Background(), "k", func() (QueryResponse, error) {
+		<-release
+		return QueryResponse{}, nil
+	})
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		_, started := g.flights["k"]
+		g.mu.Unlock()
+		if started {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("flight did not start")
+		}
+	}
+	waitCtx, stop := context.WithCancel(context.Background())
+	stop()
+	if _, err := g.do(waitCtx, "k", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCoalesceKey(t *testing.T) {
+	a, ok := coalesceKey(QueryRequest{SQL: "SELECT *  FROM\n users", Limit: 5})
+	if !ok {
+		t.Fatal("expected SELECT to coalesce")
+	}
+	if b, _ := coalesceKey(QueryRequest{SQL: "SELECT * FROM users", Limit: 5}); b != a {
+		t.Fatalf("whitespace should be normalized: %q vs %q", a, b)
+	}
+	if b, _ := coalesceKey(QueryRequest{SQL: "SELECT * FROM users", Limit: 6}); b == a {
+		t.Fatal("different limits should not share a key")
+	}
+	if _, ok := coalesceKey(QueryRequest{SQL: "INSERT INTO users VALUES (2, 'Bob')"}); ok {
+		t.Fatal("writes must never coalesce")
+	}
+	// Whitespace inside literals is data, not formatting.
+	two, _ := coalesceKey(QueryRequest{SQL: "SELECT * FROM users WHERE name = 'a  b'"})
+	one, _ := coalesceKey(QueryRequest{SQL: "SELECT * FROM users WHERE name = 'a b'"})
+	if one == two {
+		t.Fatalf("literals differing in whitespace share key %q", one)
+	}
+	if b, _ := coalesceKey(QueryRequest{SQL: " SELECT *\tFROM users  WHERE name = 'a  b' "}); b != two {
+		t.Fatalf("whitespace outside the literal should be normalized: %q vs %q", two, b)
+	}
+}
+
+func TestSelfTests(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/selftest.json"
+	os.WriteFile(path, []byte(`[
+		{"sql": "SELECT * FROM users", "columns": ["id", "name"], "rows": [[1, "Alice"]]},
+		{"sql": "SELECT * FROM users", "rows": [[1, "Alice"]]}
+	]`), 0o600)
+	cases, err := loadSelfTests(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runSelfTests(context.Background(), NewEngine(), cases); err != nil {
+		t.Fatalf("expected self-tests to pass, got %v", err)
+	}
+
+	cases[1].Rows = json.RawMessage(`[[1, "Bob"]]`)
+	if err := runSelfTests(context.Background(), NewEngine(), cases); err == nil || !strings.Contains(err.Error(), "self-test 1") {
+		t.Fatalf("expected self-test 1 to fail, got %v", err)
+	}
+	cases[1] = selfTestCase{SQL: "", Rows: json.RawMessage(`[]`)}
+	if err := runSelfTests(context.Background(), NewEngine(), cases); err == nil {
+		t.Fatal("expected failing query to fail the self-test")
+	}
+
+	os.WriteFile(path, []byte(`[{"sql": "SELECT 1"}]`), 0o600)
+	if _, err := loadSelfTests(path); err == nil {
+		t.Fatal("expected error for case without rows")
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	before := stats.retries.Load()
+	calls := 0
+	flaky := func() (QueryResponse, error) {
+		calls++
+		if calls < 3 {
+			return QueryResponse{}, fmt.Errorf("%w: lock timeout", ErrTransient)
+		}
+		return QueryResponse{Columns: []string{"id"}}, nil
+	}
+	if _, err := withRetry(context.Background(), 5, time.Millisecond, flaky); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	if calls != 3 || stats.retries.Load()-before != 2 {
+		t.Fatalf("expected 3 calls and 2 retries, got %d calls and %d retries", calls, stats.retries.Load()-before)
+	}
+
+	calls = 0
+	permanent := func() (QueryResponse, error) {
+		calls++
+		return QueryResponse{}, errors.New("syntax error")
+	}
+	if _, err := withRetry(context.Background(), 5, time.Millisecond, permanent); err == nil || calls != 1 {
+		t.Fatalf("expected one call for a permanent error, got %d (%v)", calls, err)
+	}
+
+	// The deadline leaves no room for the backoff, so no retry happens.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	calls = 0
+	always := func() (QueryResponse, error) {
+		calls++
+		return QueryResponse{}, ErrTransient
+	}
+	if _, err := withRetry(ctx, 5, time.Second, always); !errors.Is(err, ErrTransient) || calls != 1 {
+		t.Fatalf("expected deadline to stop retries, got %d calls (%v)", calls, err)
+	}
+
+	// Backoff doubles up to MaxRetryBackoff and never overflows.
+	for attempt, want := range map[int]time.Duration{0: 10 * time.Millisecond, 3: 80 * time.Millisecond, 7: MaxRetryBackoff, 64: MaxRetryBackoff, 1000: MaxRetryBackoff} {
+		if got := retryWait(DefaultRetryBackoff, attempt); got != want {
+			t.Fatalf("attempt %d: expected wait %v, got %v", attempt, want, got)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	got := splitStatements("SELECT * FROM users; SELECT 'a;b' FROM users;;  ")
+	want := []string{"SELECT * FROM users", "SELECT 'a;b' FROM users"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestHandleScript(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	run := func(e *Engine, body string) ScriptResponse {
+		w := httptest.NewRecorder()
+		handleScript(e)(w, httptest.NewRequest("POST", "/script", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var resp ScriptResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		return resp
+	}
+
+	// SLEEP exceeds the script deadline, so the script stops there.
+	resp := run(NewEngine(), `{"script":"SELECT * FROM users; SLEEP; SELECT * FROM users","timeout_ms":50}`)
+	if len(resp.Results) != 2 || resp.Results[1].Error == nil || resp.Results[1].Error.Code != http.StatusRequestTimeout {
+		t.Fatalf("expected stop after the failing statement, got %+v", resp.Results)
+	}
+	if resp.Results[0].Index != 0 || len(resp.Results[0].Rows) != 1 {
+		t.Fatalf("unexpected first result %+v", resp.Results[0])
+	}
+
+	// The script timeout is capped by the server maximum.
+	capped := NewEngine()
+	capped.maxTimeout = 50 * time.Millisecond
+	resp = run(capped, `{"script":"SLEEP","timeout_ms":10000}`)
+	if len(resp.Results) != 1 || resp.Results[0].Error == nil || resp.Results[0].Error.Code != http.StatusRequestTimeout {
+		t.Fatalf("expected the capped deadline to stop SLEEP, got %+v", resp.Results)
+	}
+
+	// Every statement fails the column cap.
+	narrow := NewEngine()
+	narrow.maxColumns = 1
+	script := `"script":"SELECT * FROM users; SELECT * FROM users; SELECT * FROM users"`
+	if resp := run(narrow, `{`+script+`}`); len(resp.Results) != 1 {
+		t.Fatalf("expected stop on first error, got %d results", len(resp.Results))
+	}
+	resp = run(narrow, `{`+script+`,"continue_on_error":true}`)
+	if len(resp.Results) != 3 || resp.Results[2].Index != 2 || resp.Results[2].Error == nil {
+		t.Fatalf("expected all statements to run, got %+v", resp.Results)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("MAX_RESPONSE_BYTES", "22")
+	defer os.Unsetenv("MAX_RESPONSE_BYTES")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "Alice"}, {2, "Bob"}, {3, "Carol"}},
+	}
+	body := `{"sql":"SELECT * FROM users"}`
+
+	// Buffered JSON fails as a whole.
+	w := httptest.NewRecorder()
+	handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+	var resp QueryResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	if w.Code != http.StatusBadRequest || resp.Error == nil || !strings.Contains(resp.Error.Message, ErrResponseTooLarge.Error()) {
+		t.Fatalf("expected response too large error, got %d %+v", w.Code, resp.Error)
+	}
+
+	// Streamed CSV is cut at the last whole record that fits.
+	w = httptest.NewRecorder()
+	handleQuery(e)(w, httptest.NewRequest("POST", "/query?format=csv", strings.NewReader(body)))
+	if want := "id,name\n1,Alice\n2,Bob\n"; w.Body.String() != want {
+		t.Fatalf("expected %q, got %q", want, w.Body.String())
+	}
+}
+
+func TestBoolFormat(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	defer os.Unsetenv("BOOL_FORMAT")
+
+	e := &Engine{
+		table:   "flags",
+		columns: []string{"id", "on"},
+		rows:    [][]interface{}{{1, true}, {2, false}},
+	}
+	cases := []struct {
+		style, json, csv string
+	}{
+		{"", `[[1,true],[2,false]]`, "id,on\n1,true\n2,false\n"},
+		{"numeric", `[[1,1],[2,0]]`, "id,on\n1,1\n2,0\n"},
+		{"char", `[[1,"t"],[2,"f"]]`, "id,on\n1,t\n2,f\n"},
+	}
+	for _, c := range cases {
+		os.Setenv("BOOL_FORMAT", c.style)
+		body := `{"sql":"SELECT * FROM flags"}`
+
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+		var resp struct{ Rows json.RawMessage }
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		if string(resp.Rows) != c.json {
+			t.Fatalf("BOOL_FORMAT=%q: expected rows %s, got %s", c.style, c.json, resp.Rows)
+		}
+
+		w = httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", "/query?format=csv", strings.NewReader(body)))
+		if w.Body.String() != c.csv {
+			t.Fatalf("BOOL_FORMAT=%q: expected csv %q, got %q", c.style, c.csv, w.Body.String())
+		}
+	}
+	if e.rows[0][1] != true {
+		t.Fatal("engine rows were modified")
+	}
+}
+
+func TestCoerceString(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		table:   "flags",
+		columns: []string{"id", "on", "note", "score"},
+		rows:    [][]interface{}{{9007199254740993, true, nil, 1.5}, {2, false, "x", 3.0}},
+	}
+	run := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+		return w
+	}
+
+	w := run(`{"sql":"SELECT * FROM flags","coerce":"string"}`)
+	var resp struct{ Rows json.RawMessage }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode resp: %v", err)
+	}
+	want := `[["9007199254740993","true",null,"1.5"],["2","false","x","3"]]`
+	if string(resp.Rows) != want {
+		t.Fatalf("expected rows %s, got %s", want, resp.Rows)
+	}
+	if w := run(`{"sql":"SELECT * FROM flags","coerce":"int"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unsupported coerce, got %d", w.Code)
+	}
+	if e.rows[0][0] != 9007199254740993 {
+		t.Fatal("engine rows were modified")
+	}
+}
+
+func TestResultHashes(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "Ada"}, {2, "Grace"}},
+	}
+	query := func(body string) (int, QueryResponse) {
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+		var resp QueryResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	_, rows := query(`{"sql":"SELECT * FROM users","hash":"row"}`)
+	sum := sha256.Sum256([]byte(`[1,"Ada"]`))
+	if len(rows.RowHashes) != 2 || rows.RowHashes[0] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected row hashes %v", rows.RowHashes)
+	}
+	if rows.ResultHash != "" {
+		t.Fatal("result hash set for hash=row")
+	}
+	_, before := query(`{"sql":"SELECT * FROM users","hash":"result"}`)
+	_, again := query(`{"sql":"SELECT * FROM users","hash":"result"}`)
+	if before.ResultHash == "" || before.ResultHash != again.ResultHash {
+		t.Fatalf("result hash not stable: %q vs %q", before.ResultHash, again.ResultHash)
+	}
+	e.rows[1][1] = "Hopper"
+	_, after := query(`{"sql":"SELECT * FROM users","hash":"result"}`)
+	if after.ResultHash == before.ResultHash {
+		t.Fatal("result hash unchanged after data changed")
+	}
+
+	if _, plain := query(`{"sql":"SELECT * FROM users"}`); plain.RowHashes != nil || plain.ResultHash != "" {
+		t.Fatal("hashes returned without being requested")
+	}
+	if code, _ := query(`{"sql":"SELECT * FROM users","hash":"md5"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown hash mode, got %d", code)
+	}
+}
+
+func TestPaginationMeta(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id"},
+		rows:    [][]interface{}{{1}, {2}, {3}, {4}, {5}},
+	}
+	query := func(url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		return w
+	}
+
+	w := query("/query", `{"sql":"SELECT * FROM users","limit":2,"offset":1,"pagination_meta":"headers"}`)
+	if got := w.Header().Get("X-Total-Count"); got != "5" {
+		t.Fatalf("expected X-Total-Count 5, got %q", got)
+	}
+	if got := w.Header().Get("X-Returned-Count"); got != "2" {
+		t.Fatalf("expected X-Returned-Count 2, got %q", got)
+	}
+	if got := w.Header().Get("X-Next-Offset"); got != "3" {
+		t.Fatalf("expected X-Next-Offset 3, got %q", got)
+	}
+	if strings.Contains(w.Body.String(), "pagination") {
+		t.Fatalf("expected metadata only in headers, got %s", w.Body)
+	}
+
+	w = query("/query?limit=2&offset=3", `{"sql":"SELECT * FROM users","pagination_meta":"body"}`)
+	if w.Header().Get("X-Total-Count") != "" {
+		t.Fatal("expected no headers for body placement")
+	}
+	var resp QueryResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if p := resp.Pagination; p == nil || p.TotalRows != 5 || p.Returned != 2 || p.NextOffset != nil {
+		t.Fatalf("expected last page of 2 from 5 rows, got %+v", p)
+	}
+
+	w = query("/query?format=csv", `{"sql":"SELECT * FROM users","limit":4,"pagination_meta":"headers"}`)
+	if w.Header().Get("X-Next-Offset") != "4" || !strings.HasPrefix(w.Body.String(), "id\n") {
+		t.Fatalf("expected headers on CSV output, got %v", w.Header())
+	}
+	if w = query("/query?format=csv", `{"sql":"SELECT * FROM users","pagination_meta":"both"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for body metadata on CSV, got %d", w.Code)
+	}
+}
+
+func TestSpillToTempFile(t *testing.T) {
+	resp := QueryResponse{
+		Columns:  []string{"id", "name"},
+		Rows:     [][]interface{}{{1, "a<b"}, {2, nil}, {3, "c"}},
+		Warnings: []string{"w"},
+	}
+	for _, wrap := range []func(QueryResponse) interface{}{
+		func(r QueryResponse) interface{} { return r },
+		func(r QueryResponse) interface{} { return withAllFields(r) },
+	} {
+		var want, got bytes.Buffer
+		json.NewEncoder(&want).Encode(wrap(resp))
+		if err := encodeRowsJSON(&got, resp, wrap); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != want.String() {
+			t.Fatalf("expected %s, got %s", want.String(), got.String())
+		}
+	}
+
+	dir := t.TempDir()
+	os.Setenv("DEV_MODE", "1")
+	os.Setenv("SPILL_THRESHOLD_BYTES", "16")
+	os.Setenv("SPILL_DIR", dir)
+	defer os.Unsetenv("DEV_MODE")
+	defer os.Unsetenv("SPILL_THRESHOLD_BYTES")
+	defer os.Unsetenv("SPILL_DIR")
+
+	buf := &spillBuffer{cfg: spillConfigFromEnv()}
+	buf.Write([]byte("0123456789"))
+	if buf.file != nil {
+		t.Fatal("spilled below the threshold")
+	}
+	buf.Write([]byte("0123456789"))
+	if buf.file == nil {
+		t.Fatal("expected a temp file past the threshold")
+	}
+	var out bytes.Buffer
+	buf.WriteTo(&out)
+	buf.Close()
+	if out.String() != "01234567890123456789" || buf.Len() != 20 {
+		t.Fatalf("unexpected spilled content %q", out.String())
+	}
+
+	e := &Engine{table: "users", columns: resp.Columns, rows: resp.Rows}
+	w := httptest.NewRecorder()
+	handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT * FROM users"}`)))
+	if want := `{"columns":["id","name"],"rows":[[1,"a\u003cb"],[2,null],[3,"c"]]}` + "\n"; w.Body.String() != want {
+		t.Fatalf("expected %s, got %s", want, w.Body)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("temp files left behind: %v", entries)
+	}
+
+	// The size cap stops the spill rather than being checked afterwards.
+	capped := &spillBuffer{cfg: spillConfigFromEnv(), limit: 24}
+	capped.Write([]byte("0123456789"))
+	capped.Write([]byte("0123456789"))
+	if _, err := capped.Write([]byte("0123456789")); !errors.Is(err, ErrResponseTooLarge) || capped.Len() != 20 {
+		t.Fatalf("expected the over-cap write to be rejected, got %v after %d bytes", err, capped.Len())
+	}
+	capped.Close()
+
+	os.Setenv("MAX_RESPONSE_BYTES", "40")
+	defer os.Unsetenv("MAX_RESPONSE_BYTES")
+	w = httptest.NewRecorder()
+	handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT * FROM users"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrResponseTooLarge.Error()) {
+		t.Fatalf("expected response too large, got %d %s", w.Code, w.Body)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("temp files left behind: %v", entries)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	os.Setenv("API_TOKEN", "secret")
+	defer os.Unsetenv("API_TOKEN")
+	e := &Engine{maxColumns: 7, maxTimeout: 2 * time.Second}
+
+	w := httptest.NewRecorder()
+	handleCapabilities(e)(w, httptest.NewRequest("GET", "/capabilities", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("expected cacheable 200, got %d %v", w.Code, w.Header())
+	}
+	var c Capabilities
+	if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.Formats, ",") != "columnar,csv,json" {
+		t.Fatalf("unexpected formats %q", c.Formats)
+	}
+	if strings.Join(c.ExportFormats, ",") != "csv,ndjson" {
+		t.Fatalf("unexpected export formats %q", c.ExportFormats)
+	}
+	if strings.Join(c.Core.Statements, ",") != "SELECT,INSERT" || !slices.Contains(c.Core.SetOperators, "EXCEPT") || !slices.Contains(c.Core.Functions, "COALESCE") {
+		t.Fatalf("unexpected core features %+v", c.Core)
+	}
+	if len(c.Auth) != 1 || c.Auth[0] != "bearer" {
+		t.Fatalf("expected bearer auth, got %q", c.Auth)
+	}
+	if c.Flags != nil {
+		t.Fatalf("flags listed outside dev mode: %q", c.Flags)
+	}
+	if c.Limits["max_result_columns"] != 7 || c.Limits["max_timeout_ms"] != 2000 || c.Limits["default_timeout_ms"] != 5000 {
+		t.Fatalf("unexpected limits %v", c.Limits)
+	}
+}
+
+func TestDefaultFormat(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	os.Setenv("DEFAULT_FORMAT", "csv")
+	defer os.Unsetenv("DEV_MODE")
+	defer os.Unsetenv("DEFAULT_FORMAT")
+	h := handleQuery(NewEngine())
+	query := func(url, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", url, strings.NewReader(`{"sql":"SELECT * FROM users"}`))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	cases := []struct{ url, accept, contentType string }{
+		{"/query", "", "text/csv"},
+		{"/query", "*/*", "text/csv"},
+		{"/query", "application/json", "application/json"},
+		{"/query?format=json", "text/csv", "application/json"},
+	}
+	for _, c := range cases {
+		if got := query(c.url, c.accept).Header().Get("Content-Type"); got != c.contentType {
+			t.Fatalf("%s with Accept %q: expected %s, got %s", c.url, c.accept, c.contentType, got)
+		}
+	}
+
+	os.Setenv("DEFAULT_FORMAT", "xml")
+	if _, err := defaultFormatFromEnv(); err == nil {
+		t.Fatal("expected error for unknown DEFAULT_FORMAT")
+	}
+}
+
+func TestErrorVerbosity(t *testing.T) {
+	defer os.Unsetenv("ERROR_VERBOSITY")
+	e := NewEngine()
+	e.maxColumns = 1
+	query := func() QueryResponse {
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT * FROM users"}`)))
+		var resp QueryResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode resp: %v", err)
+		}
+		if resp.Error == nil || resp.Error.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 error, got %+v", resp.Error)
+		}
+		return resp
+	}
+
+	os.Setenv("ERROR_VERBOSITY", "generic")
+	resp := query()
+	if resp.Error.Message != "query failed" || len(resp.Error.ID) != 16 {
+		t.Fatalf("expected generic message with id, got %+v", resp.Error)
+	}
+
+	os.Setenv("ERROR_VERBOSITY", "full")
+	resp = query()
+	if !strings.Contains(resp.Error.Message, ErrTooManyColumns.Error()) || resp.Error.ID != "" {
+		t.Fatalf("expected full message, got %+v", resp.Error)
+	}
+}
+
+func TestErrorVerbosityAcrossEndpoints(t *testing.T) {
+	os.Setenv("ERROR_VERBOSITY", "generic")
+	defer os.Unsetenv("ERROR_VERBOSITY")
+	e := NewEngine()
+	e.maxColumns = 1
+	tmpl, err := parseTemplate("SELECT * FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path, body string
+		h          http.HandlerFunc
+	}{
+		{"/script", `{"script":"SELECT * FROM users"}`, handleScript(e)},
+		{"/diff", `{"sql":"SELECT * FROM users","key":["id"]}`, handleDiff(e)},
+		{"/run/all", `{}`, handleRun(e, map[string]queryTemplate{"all": tmpl})},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		c.h(w, httptest.NewRequest("POST", c.path, strings.NewReader(c.body)))
+		body := w.Body.String()
+		if strings.Contains(body, ErrTooManyColumns.Error()) || !strings.Contains(body, `"query failed"`) {
+			t.Fatalf("%s: expected a generic error, got %s", c.path, body)
+		}
+	}
+}
+
+func TestHandleQueryAllowedCIDRs(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("ALLOWED_CIDRS", "10.0.0.0/8, 2001:db8::/32, 192.0.2.7")
+	defer os.Unsetenv("ALLOWED_CIDRS")
+	os.Setenv("TRUSTED_PROXIES", "172.16.0.1")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+
+	h := allowClients(handleQuery(NewEngine()))
+	cases := []struct {
+		remote, xff string
+		want        int
+	}{
+		{"10.1.2.3:5000", "", http.StatusOK},
+		{"[2001:db8::1]:5000", "", http.StatusOK},
+		{"192.0.2.7:5000", "", http.StatusOK},
+		{"192.0.2.8:5000", "", http.StatusForbidden},
+		{"[2001:db9::1]:5000", "", http.StatusForbidden},
+		// Behind the trusted proxy the forwarded client address counts.
+		{"172.16.0.1:5000", "10.9.9.9", http.StatusOK},
+		{"172.16.0.1:5000", "203.0.113.5", http.StatusForbidden},
+		// An untrusted peer cannot claim an allowed address.
+		{"203.0.113.5:5000", "10.9.9.9", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/query", strings.NewReader(`{"sql":"SELECT * FROM users"}`))
+		req.RemoteAddr = c.remote
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != c.want {
+			t.Fatalf("%s (xff %q): expected %d, got %d", c.remote, c.xff, c.want, w.Code)
+		}
+	}
+}
+
+func TestAllowedCIDRsGateEveryQueryRoute(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("EXPORT_ENABLED", "1")
+	defer os.Unsetenv("EXPORT_ENABLED")
+	os.Setenv("ALLOWED_CIDRS", "10.0.0.0/8")
+	defer os.Unsetenv("ALLOWED_CIDRS")
+
+	e := NewEngine()
+	tmpl, err := parseTemplate("SELECT * FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := []struct {
+		method, path, body string
+		h                  http.HandlerFunc
+	}{
+		{"POST", "/script", `{"script":"SELECT * FROM users"}`, handleScript(e)},
+		{"POST", "/diff", `{"sql":"SELECT * FROM users","key":["id"]}`, handleDiff(e)},
+		{"GET", "/export?table=users", "", handleExport(e)},
+		{"GET", "/profile?table=users", "", handleProfile(e)},
+		{"POST", "/run/all", `{}`, handleRun(e, map[string]queryTemplate{"all": tmpl})},
+	}
+	for _, rt := range routes {
+		for remote, want := range map[string]int{"10.0.0.1:1": http.StatusOK, "192.0.2.1:1": http.StatusForbidden} {
+			req := httptest.NewRequest(rt.method, rt.path, strings.NewReader(rt.body))
+			req.RemoteAddr = remote
+			w := httptest.NewRecorder()
+			allowClients(rt.h)(w, req)
+			if w.Code != want {
+				t.Fatalf("%s from %s: expected %d, got %d: %s", rt.path, remote, want, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parsePrefixes("10.0.0.0/8, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, remote string
+		headers      map[string]string
+		want         string
+	}{
+		{"direct", "203.0.113.5:1", nil, "203.0.113.5"},
+		{"untrusted peer spoofing xff", "203.0.113.5:1", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.5"},
+		{"untrusted peer spoofing x-real-ip", "203.0.113.5:1", map[string]string{"X-Real-IP": "1.1.1.1"}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "198.51.100.2"}, "198.51.100.2"},
+		{"client-prepended hop ignored", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.2"}, "198.51.100.2"},
+		{"proxy chain", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "198.51.100.2, 10.0.0.7"}, "198.51.100.2"},
+		{"x-real-ip from trusted proxy", "[fd00::1]:1", map[string]string{"X-Real-IP": "2001:db8::9"}, "2001:db8::9"},
+		{"garbage header", "10.0.0.1:1", map[string]string{"X-Forwarded-For": "nonsense"}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = c.remote
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		got, ok := clientIP(req, trusted)
+		if !ok || got.String() != c.want {
+			t.Fatalf("%s: expected %s, got %v (ok=%v)", c.name, c.want, got, ok)
+		}
+	}
+}
+
+func TestColumnarFormat(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "a"}, {2, "b"}, {3, nil}},
+	}
+	query := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, httptest.NewRequest("POST", target, strings.NewReader(`{"sql":"SELECT * FROM users"}`)))
+		return w
+	}
+
+	var rows QueryResponse
+	if err := json.NewDecoder(query("/query").Body).Decode(&rows); err != nil {
+		t.Fatalf("decode rows: %v", err)
+	}
+	w := query("/query?format=columnar")
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON content type, got %q", ct)
+	}
+	var cols ColumnarResponse
+	if err := json.NewDecoder(w.Body).Decode(&cols); err != nil {
+		t.Fatalf("decode columnar: %v", err)
+	}
+	if strings.Join(cols.Columns, ",") != strings.Join(rows.Columns, ",") {
+		t.Fatalf("columns differ: %v vs %v", cols.Columns, rows.Columns)
+	}
+	for j, row := range rows.Rows {
+		for i, c := range rows.Columns {
+			if cols.Data[c][j] != row[i] {
+				t.Fatalf("row %d column %s: expected %v, got %v", j, c, row[i], cols.Data[c][j])
+			}
+		}
+	}
+}
+
+func TestExtractHints(t *testing.T) {
+	cases := []struct {
+		in, sql string
+		ms      int
+	}{
+		{"SELECT 1", "SELECT 1", 0},
+		{"/*+ TIMEOUT(500) */ SELECT 1", "SELECT 1", 500},
+		{"  /*+ timeout(20) PARALLEL(4) */SELECT 1", "SELECT 1", 20},
+		{"/*+ TIMEOUT(abc) */ SELECT 1", "SELECT 1", 0},
+		{"/*+ TIMEOUT(5) SELECT 1", "/*+ TIMEOUT(5) SELECT 1", 0},
+		{"/* TIMEOUT(5) */ SELECT 1", "/* TIMEOUT(5) */ SELECT 1", 0},
+	}
+	for _, c := range cases {
+		sql, ms, _ := extractHints(c.in)
+		if sql != c.sql || ms != c.ms {
+			t.Fatalf("%q: expected (%q, %d), got (%q, %d)", c.in, c.sql, c.ms, sql, ms)
+		}
+	}
+
+	// Ignored hints are logged at debug level.
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer slog.SetDefault(prev)
+	extractHints("/*+ PARALLEL(4) TIMEOUT(x) */ SELECT 1")
+	if out := buf.String(); !strings.Contains(out, "hint=PARALLEL(4)") || !strings.Contains(out, "hint=TIMEOUT(x)") {
+		t.Fatalf("expected debug logs for ignored hints, got %q", out)
+	}
+}
+
+func TestQueryWarnings(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	e := &Engine{
+		table:      "users",
+		columns:    []string{"id"},
+		rows:       [][]interface{}{{1}, {2}, {3}},
+		maxTimeout: time.Second,
+	}
+	query := func(body string, header http.Header) QueryResponse {
+		req := httptest.NewRequest("POST", "/query", strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handleQuery(e)(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+		}
+		var resp QueryResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+
+	if resp := query(`{"sql":"SELECT * FROM users"}`, nil); resp.Warnings != nil {
+		t.Fatalf("expected no warnings, got %q", resp.Warnings)
+	}
+	resp := query(`{"sql":"SELECT * FROM users"}`, http.Header{"X-Max-Rows": {"2"}})
+	if len(resp.Rows) != 2 || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "truncated to 2 rows") {
+		t.Fatalf("expected truncation warning, got %d rows and %q", len(resp.Rows), resp.Warnings)
+	}
+	resp = query(`{"sql":"/*+ PARALLEL(4) TIMEOUT(50) */ SELECT * FROM users","timeout_ms":5000}`, nil)
+	want := []string{
+		"ignoring unknown hint PARALLEL(4)",
+		"TIMEOUT hint ignored: timeout_ms takes precedence",
+		"timeout of 5000ms capped to the server maximum of 1000ms",
+	}
+	if strings.Join(resp.Warnings, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %q, got %q", want, resp.Warnings)
+	}
+}
+
+func TestRunQueryTimeoutHint(t *testing.T) {
+	e := NewEngine()
+	if _, err := runQuery(context.Background(), e, QueryRequest{SQL: "/*+ TIMEOUT(20) */ SLEEP"}); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("expected hint to time out the query, got %v", err)
+	}
+	// An explicit timeout_ms wins over the hint, but the engine maximum
+	// clamps both.
+	if _, err := runQuery(context.Background(), e, QueryRequest{SQL: "/*+ TIMEOUT(20) */ SLEEP", TimeoutMS: 1000}); err != nil {
+		t.Fatalf("expected timeout_ms to override the hint, got %v", err)
+	}
+	e.maxTimeout = 20 * time.Millisecond
+	if _, err := runQuery(context.Background(), e, QueryRequest{SQL: "SLEEP", TimeoutMS: 1000}); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("expected timeout_ms to be clamped, got %v", err)
+	}
+}
+
+func TestHandleExport(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	e := &Engine{
+		table:   "users",
+		columns: []string{"id", "name"},
+		rows:    [][]interface{}{{1, "Alice"}, {2, nil}},
+	}
+
+	w := httptest.NewRecorder()
+	handleExport(e)(w, httptest.NewRequest("GET", "/export?table=users", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected export to be off by default, got %d", w.Code)
+	}
+
+	os.Setenv("EXPORT_ENABLED", "1")
+	defer os.Unsetenv("EXPORT_ENABLED")
+	h := handleExport(e)
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/export?table=users&format=csv", nil))
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="users.csv"` {
+		t.Fatalf("unexpected Content-Disposition %q", got)
+	}
+	if want := "id,name\n1,Alice\n2,\n"; w.Body.String() != want {
+		t.Fatalf("expected %q, got %q", want, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/export?table=users&format=ndjson", nil))
+	if want := "{\"id\":1,\"name\":\"Alice\"}\n{\"id\":2,\"name\":null}\n"; w.Body.String() != want {
+		t.Fatalf("expected %q, got %q", want, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/export?table=orders", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown table, got %d", w.Code)
+	}
+
+	// NDJSON is keyed by column name, so repeated names follow
+	// DUPLICATE_COLUMNS as keyed /query output does.
+	dup := &Engine{table: "users", columns: []string{"id", "id"}, rows: [][]interface{}{{1, 10}}}
+	defer os.Unsetenv("DUPLICATE_COLUMNS")
+	for _, c := range []struct {
+		policy, format string
+		code           int
+		want           string
+	}{
+		{"", "ndjson", 200, `{"id":1,"id_1":10}` + "\n"},
+		{"keep", "ndjson", 400, ""},
+		{"keep", "csv", 200, "id,id\n1,10\n"},
+		{"error", "csv", 400, ""},
+	} {
+		os.Setenv("DUPLICATE_COLUMNS", c.policy)
+		w = httptest.NewRecorder()
+		handleExport(dup)(w, httptest.NewRequest("GET", "/export?table=users&format="+c.format, nil))
+		if w.Code != c.code || (c.want != "" && w.Body.String() != c.want) {
+			t.Fatalf("%q %s: expected %d %q, got %d %q", c.policy, c.format, c.code, c.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestREPLWebSocket(t *testing.T) {
+	os.Setenv("API_TOKEN", "secret")
+	defer os.Unsetenv("API_TOKEN")
+
+	// The example handshake from RFC 6455 section 1.3.
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key %s", got)
+	}
+
+	os.Setenv("ALLOWED_CIDRS", "127.0.0.1")
+	defer os.Unsetenv("ALLOWED_CIDRS")
+	os.Setenv("REPL_ALLOWED_ORIGINS", "https://console.example")
+	defer os.Unsetenv("REPL_ALLOWED_ORIGINS")
+	srv := httptest.NewServer(allowClients(handleREPL(NewEngine())))
+	defer srv.Close()
+	// dial sends an upgrade request with the extra header lines in headers.
+	dial := func(headers string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		fmt.Fprintf(conn, "GET /repl HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n%s\r\n", headers)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read handshake: %v", err)
+		}
+		return conn, br, resp
+	}
+	// send writes a masked client frame, as browsers do.
+	send := func(conn net.Conn, head byte, payload string) {
+		mask := [4]byte{1, 2, 3, 4}
+		frame := []byte{head, 0x80 | byte(len(payload))}
+		frame = append(frame, mask[:]...)
+		for i := 0; i < len(payload); i++ {
+			frame = append(frame, payload[i]^mask[i%4])
+		}
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatalf("write frame: %v", err)
+		}
+	}
+	recv := func(br *bufio.Reader) (byte, []byte) {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(br, head); err != nil {
+			t.Fatalf("read frame: %v", err)
+		}
+		n := int(head[1])
+		if n == 126 {
+			ext := make([]byte, 2)
+			io.ReadFull(br, ext)
+			n = int(ext[0])<<8 | int(ext[1])
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatalf("read payload: %v", err)
+		}
+		return head[0] & 0x0f, payload
+	}
+
+	for headers, want := range map[string]int{
+		"Authorization: Bearer wrong\r\n":                                     http.StatusUnauthorized,
+		"Authorization: Bearer secret\r\nOrigin: https://evil.example\r\n":    http.StatusForbidden,
+		"Authorization: Bearer secret\r\nOrigin: https://console.example\r\n": http.StatusSwitchingProtocols,
+		"Authorization: Bearer secret\r\nOrigin: http://x\r\n":                http.StatusSwitchingProtocols,
+	} {
+		conn, _, resp := dial(headers)
+		conn.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%q: expected %d, got %d", headers, want, resp.StatusCode)
+		}
+	}
+
+	conn, br, resp := dial("Authorization: Bearer secret\r\n")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// Two statements on one connection, the second split across frames.
+	send(conn, 0x81, "SELECT * FROM users")
+	send(conn, 0x01, "SELECT * ")
+	send(conn, 0x80, "FROM users")
+	for i := 0; i < 2; i++ {
+		op, body := recv(br)
+		var qr QueryResponse
+		if err := json.Unmarshal(body, &qr); err != nil || op != wsText {
+			t.Fatalf("statement %d: opcode %d, body %s, err %v", i, op, body, err)
+		}
+		if len(qr.Rows) != 1 || qr.Error != nil {
+			t.Fatalf("statement %d: unexpected result %s", i, body)
+		}
+	}
+	send(conn, 0x81, "")
+	// Outside DEV_MODE engine errors are redacted, as on /query.
+	if _, body := recv(br); !strings.Contains(string(body), `"query failed"`) {
+		t.Fatalf("expected a generic error for empty SQL, got %s", body)
+	}
+
+	send(conn, 0x89, "hi")
+	if op, body := recv(br); op != wsPong || string(body) != "hi" {
+		t.Fatalf("expected pong, got opcode %d %q", op, body)
+	}
+	send(conn, 0x88, "")
+	if op, _ := recv(br); op != wsClose {
+		t.Fatalf("expected close, got opcode %d", op)
+	}
+}
+
+func TestREPLAllowedCIDRs(t *testing.T) {
+	os.Setenv("DEV_MODE", "1")
+	defer os.Unsetenv("DEV_MODE")
+	os.Setenv("ALLOWED_CIDRS", "10.0.0.0/8")
+	defer os.Unsetenv("ALLOWED_CIDRS")
+
+	req := httptest.NewRequest("GET", "/repl", nil)
+	req.RemoteAddr = "192.0.2.1:1"
+	w := httptest.NewRecorder()
+	allowClients(handleREPL(NewEngine()))(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 outside ALLOWED_CIDRS, got %d", w.Code)
+	}
+}
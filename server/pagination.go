@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Placements for pagination metadata, chosen with the request's
+// "pagination_meta" field.
+const (
+	paginationBody    = "body"
+	paginationHeaders = "headers"
+	paginationBoth    = "both"
+)
+
+// Pagination describes where a page sits in the full result.
+// NextOffset is omitted on the last page.
+type Pagination struct {
+	TotalRows  int  `json:"total_rows"`
+	Returned   int  `json:"returned"`
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// validPaginationMeta checks the pagination_meta option of a request.
+// Metadata in the body needs plain (unkeyed) JSON output to carry it.
+func validPaginationMeta(mode, format string, keyed bool) error {
+	switch mode {
+	case "", paginationHeaders:
+		return nil
+	case paginationBody, paginationBoth:
+		if format != formatJSON || keyed {
+			return fmt.Errorf("pagination_meta %q requires plain JSON output", mode)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported pagination_meta %q (want %q, %q or %q)", mode, paginationBody, paginationHeaders, paginationBoth)
+}
+
+// pagination computes the metadata for resp, a page starting at offset.
+func pagination(resp QueryResponse, offset int) Pagination {
+	p := Pagination{TotalRows: resp.total, Returned: len(resp.Rows)}
+	if next := offset + len(resp.Rows); next < resp.total {
+		p.NextOffset = &next
+	}
+	return p
+}
+
+// setPaginationHeaders echoes p as X-Total-Count, X-Returned-Count and,
+// unless this is the last page, X-Next-Offset.
+func setPaginationHeaders(h http.Header, p Pagination) {
+	h.Set("X-Total-Count", strconv.Itoa(p.TotalRows))
+	h.Set("X-Returned-Count", strconv.Itoa(p.Returned))
+	if p.NextOffset != nil {
+		h.Set("X-Next-Offset", strconv.Itoa(*p.NextOffset))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+)
+
+// ErrTableNotFound is returned when a request names a table the engine
+// does not hold.
+var ErrTableNotFound = errors.New("table not found")
+
+// Distinct-count methods accepted by PROFILE_DISTINCT.
+const (
+	distinctExact  = "exact"
+	distinctApprox = "approx"
+)
+
+// ColumnProfile summarizes one column of a table. Min and Max are only
+// set for numeric columns.
+type ColumnProfile struct {
+	Name      string   `json:"name"`
+	NullCount int      `json:"null_count"`
+	Distinct  int      `json:"distinct_count"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+}
+
+// ProfileResponse is returned by /profile.
+type ProfileResponse struct {
+	Table          string          `json:"table"`
+	Rows           int             `json:"rows"`
+	DistinctMethod string          `json:"distinct_method"`
+	Columns        []ColumnProfile `json:"columns"`
+	Error          *APIError       `json:"error,omitempty"`
+}
+
+// Profile scans table once and reports per-column statistics. With
+// approx set, distinct counts use a HyperLogLog sketch instead of
+// holding every value in memory.
+func (e *Engine) Profile(ctx context.Context, table string, approx bool) (ProfileResponse, error) {
+	if table != e.table {
+		return ProfileResponse{}, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	method := distinctExact
+	if approx {
+		method = distinctApprox
+	}
+	resp := ProfileResponse{Table: table, Rows: len(e.rows), DistinctMethod: method}
+
+	exact := make([]map[string]struct{}, len(e.columns))
+	sketches := make([]*hyperLogLog, len(e.columns))
+	resp.Columns = make([]ColumnProfile, len(e.columns))
+	for i, c := range e.columns {
+		resp.Columns[i].Name = c
+		exact[i] = map[string]struct{}{}
+		sketches[i] = newHyperLogLog()
+	}
+	for _, row := range e.rows {
+		if err := ctx.Err(); err != nil {
+			return ProfileResponse{}, contextError(ctx)
+		}
+		for i, v := range row {
+			col := &resp.Columns[i]
+			if v == nil {
+				col.NullCount++
+				continue
+			}
+			key, _ := json.Marshal(v)
+			if approx {
+				sketches[i].add(key)
+			} else {
+				exact[i][string(key)] = struct{}{}
+			}
+			if f, ok := toFloat(v); ok {
+				if col.Min == nil || f < *col.Min {
+					col.Min = &f
+				}
+				if col.Max == nil || f > *col.Max {
+					col.Max = &f
+				}
+			}
+		}
+	}
+	for i := range resp.Columns {
+		if approx {
+			resp.Columns[i].Distinct = sketches[i].estimate()
+		} else {
+			resp.Columns[i].Distinct = len(exact[i])
+		}
+	}
+	return resp, nil
+}
+
+// toFloat converts numeric cell values for min/max tracking.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func handleProfile(e *Engine) http.HandlerFunc {
+	token := os.Getenv("API_TOKEN")
+	devMode := os.Getenv("DEV_MODE") == "1"
+	approx := os.Getenv("PROFILE_DISTINCT") == distinctApprox
+	verboseErrors := verboseErrorsFromEnv()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token, devMode) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		table := r.URL.Query().Get("table")
+		if table == "" {
+			writeError(w, http.StatusBadRequest, "table parameter is required")
+			return
+		}
+		resp, err := e.Profile(r.Context(), table, approx)
+		if errors.Is(err, ErrTableNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeQueryError(w, err, "profile "+table, verboseErrors)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// hyperLogLog is a small fixed-precision HyperLogLog sketch. With 2^10
+// registers the standard error is about 3%.
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+const hllPrecision = 10
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+func (h *hyperLogLog) add(b []byte) {
+	f := fnv.New64a()
+	f.Write(b)
+	// FNV leaves the high bits of short inputs poorly mixed; apply the
+	// MurmurHash3 finalizer before splitting into index and rank.
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() int {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(est))
+}
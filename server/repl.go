@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The REPL speaks just enough of RFC 6455 for one text message per
+// statement: no extensions, no subprotocols, and unfragmented replies.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Close status codes sent by the REPL.
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseTooBig      = 1009
+)
+
+// maxREPLMessage bounds a single statement, so a client cannot make the
+// server buffer an unbounded message.
+const maxREPLMessage = 1 << 20
+
+// wsGUID is the fixed key suffix from RFC 6455 section 1.3.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// errWSClose reports a frame the REPL cannot handle, with the status to
+// close the connection with.
+type errWSClose struct {
+	code   int
+	reason string
+}
+
+func (e errWSClose) Error() string { return e.reason }
+
+// wsAccept computes the Sec-WebSocket-Accept value for key.
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHas reports whether the comma-separated header h lists token,
+// ignoring case.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readFrame reads one client frame. Client frames must be masked, and
+// control frames must be unfragmented and at most 125 bytes.
+func readFrame(r io.Reader, limit int) (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return fin, opcode, nil, errWSClose{wsCloseProtocol, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return fin, opcode, nil, errWSClose{wsCloseProtocol, "client frames must be masked"}
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (!fin || n > 125) {
+		return fin, opcode, nil, errWSClose{wsCloseProtocol, "invalid control frame"}
+	}
+	if n > uint64(limit) {
+		return fin, opcode, nil, errWSClose{wsCloseTooBig, fmt.Sprintf("message exceeds %d bytes", limit)}
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes one unmasked, unfragmented server frame.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	head := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xffff:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// closePayload is the body of a close frame: the status code, then the
+// reason.
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// originAllowed reports whether a browser may open the socket from the
+// page that sent r. Requests without Origin come from other clients and
+// are allowed; otherwise the origin must be the server's own host or one
+// listed in allowed. Without this check, any website could drive the
+// REPL whenever auth is off.
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(origin, a) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// handleREPL serves GET /repl, upgrading to a WebSocket on which every
+// text message is one SQL statement and every reply is its result in the
+// QueryResponse schema. Statements run independently, as over /query;
+// the engine keeps no per-connection state. Auth and the Origin check
+// happen on the upgrade request; main also applies allowClients.
+func handleREPL(e *Engine) http.HandlerFunc {
+	token := os.Getenv("API_TOKEN")
+	devMode := os.Getenv("DEV_MODE") == "1"
+	verboseErrors := verboseErrorsFromEnv()
+	var origins []string
+	for _, o := range strings.Split(os.Getenv("REPL_ALLOWED_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token, devMode) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if !originAllowed(r, origins) {
+			writeError(w, http.StatusForbidden, "origin not allowed")
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Method != http.MethodGet || key == "" ||
+			!headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+			writeError(w, http.StatusBadRequest, "expected a WebSocket upgrade")
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			writeError(w, http.StatusUpgradeRequired, "unsupported WebSocket version")
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "connection cannot be upgraded")
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+		if err := rw.Flush(); err != nil {
+			return
+		}
+		serveREPL(r.Context(), e, rw, verboseErrors)
+	}
+}
+
+// serveREPL runs statements from rw until the client closes the
+// connection or sends a frame the REPL cannot handle.
+func serveREPL(ctx context.Context, e *Engine, rw *bufio.ReadWriter, verboseErrors bool) {
+	send := func(opcode byte, payload []byte) bool {
+		return writeFrame(rw, opcode, payload) == nil && rw.Flush() == nil
+	}
+	var msg []byte
+	inMessage := false
+	for {
+		fin, opcode, payload, err := readFrame(rw, maxREPLMessage-len(msg))
+		var ce errWSClose
+		if errors.As(err, &ce) {
+			send(wsClose, closePayload(ce.code, ce.reason))
+			return
+		}
+		if err != nil {
+			return
+		}
+		switch {
+		case opcode == wsClose:
+			send(wsClose, closePayload(wsCloseNormal, ""))
+			return
+		case opcode == wsPing:
+			if !send(wsPong, payload) {
+				return
+			}
+			continue
+		case opcode == wsPong:
+			continue
+		case opcode == wsBinary:
+			send(wsClose, closePayload(wsCloseUnsupported, "only text messages are accepted"))
+			return
+		case opcode == wsText && !inMessage:
+			msg = payload
+		case opcode == wsContinuation && inMessage:
+			msg = append(msg, payload...)
+		default:
+			send(wsClose, closePayload(wsCloseProtocol, "unexpected frame"))
+			return
+		}
+		inMessage = !fin
+		if inMessage {
+			continue
+		}
+
+		sql := strings.TrimSpace(string(msg))
+		resp, err := runQuery(ctx, e, QueryRequest{SQL: sql})
+		if err != nil {
+			resp = QueryResponse{Error: clientQueryError(err, sql, verboseErrors)}
+		}
+		msg = nil
+		body, _ := json.Marshal(resp)
+		if !send(wsText, body) {
+			return
+		}
+	}
+}
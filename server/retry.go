@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTransient marks engine errors that may succeed when retried, such as
+// a lock timeout. Wrap it with %w to make an error retryable.
+var ErrTransient = errors.New("transient error")
+
+// DefaultRetryBackoff is the wait before the first retry; it doubles on
+// each further attempt.
+const DefaultRetryBackoff = 10 * time.Millisecond
+
+// MaxRetryBackoff caps the wait between retries, so doubling neither
+// overflows nor grows past what a request could reasonably wait.
+const MaxRetryBackoff = time.Second
+
+// MaxQueryRetries caps QUERY_RETRIES.
+const MaxQueryRetries = 10
+
+// withRetry calls fn and retries it up to retries times with exponential
+// backoff, capped at MaxRetryBackoff, while it fails with ErrTransient.
+// Other errors return at once. A retry is only attempted if its backoff
+// ends before ctx's deadline, so retrying never extends the request.
+// Each retry is counted in /stats.
+func withRetry(ctx context.Context, retries int, backoff time.Duration, fn func() (QueryResponse, error)) (QueryResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := fn()
+		if err == nil || !errors.Is(err, ErrTransient) || attempt >= retries {
+			return resp, err
+		}
+		wait := retryWait(backoff, attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return resp, err
+		}
+		stats.retries.Add(1)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return resp, err
+		}
+	}
+}
+
+// retryWait is the backoff before retry attempt+1: backoff doubled
+// attempt times, but never more than MaxRetryBackoff. It doubles step
+// by step rather than shifting so a large attempt cannot overflow.
+func retryWait(backoff time.Duration, attempt int) time.Duration {
+	wait := backoff
+	for i := 0; i < attempt && wait < MaxRetryBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, MaxRetryBackoff)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScriptRequest is the body of POST /script. Statements in Script are
+// separated by semicolons and run in order. TimeoutMS bounds the whole
+// script and is capped by MAX_QUERY_TIMEOUT_MS.
+type ScriptRequest struct {
+	Script          string `json:"script"`
+	ContinueOnError bool   `json:"continue_on_error,omitempty"`
+	TimeoutMS       int    `json:"timeout_ms,omitempty"`
+}
+
+// StatementResult is the outcome of one statement. Index is its
+// zero-based position in the script.
+type StatementResult struct {
+	Index      int             `json:"index"`
+	SQL        string          `json:"sql"`
+	Columns    []string        `json:"columns,omitempty"`
+	Rows       [][]interface{} `json:"rows,omitempty"`
+	Error      *APIError       `json:"error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+// ScriptResponse lists a result for every statement that ran.
+type ScriptResponse struct {
+	Results []StatementResult `json:"results"`
+}
+
+// splitStatements splits script at semicolons outside string literals,
+// dropping empty statements.
+func splitStatements(script string) []string {
+	var stmts []string
+	inString := false
+	start := 0
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	for i, c := range script {
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == ';' && !inString:
+			add(script[start:i])
+			start = i + 1
+		}
+	}
+	add(script[start:])
+	return stmts
+}
+
+// runScript executes each statement in order. It stops at the first
+// failure unless continueOnError is set; once ctx is done the remaining
+// statements are not run. Errors are reported as clientQueryError does.
+func runScript(ctx context.Context, e *Engine, stmts []string, continueOnError, verboseErrors bool) ScriptResponse {
+	resp := ScriptResponse{Results: make([]StatementResult, 0, len(stmts))}
+	for i, sql := range stmts {
+		start := time.Now()
+		qr, err := runQuery(ctx, e, QueryRequest{SQL: sql})
+		res := StatementResult{
+			Index:      i,
+			SQL:        sql,
+			Columns:    qr.Columns,
+			Rows:       qr.Rows,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			res.Error = clientQueryError(err, sql, verboseErrors)
+		}
+		resp.Results = append(resp.Results, res)
+		if err != nil && (!continueOnError || ctx.Err() != nil) {
+			break
+		}
+	}
+	return resp
+}
+
+// handleScript serves POST /script. The response is 200 whenever the
+// script could be run; per-statement failures are reported in the
+// results.
+func handleScript(e *Engine) http.HandlerFunc {
+	token := os.Getenv("API_TOKEN")
+	devMode := os.Getenv("DEV_MODE") == "1"
+	verboseErrors := verboseErrorsFromEnv()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token, devMode) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		var req ScriptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		stmts := splitStatements(req.Script)
+		if len(stmts) == 0 {
+			writeError(w, http.StatusBadRequest, "empty script")
+			return
+		}
+
+		// The statements run with the script's deadline rather than their
+		// own timeout_ms, so the server maximum is applied here.
+		ctx := r.Context()
+		timeout := time.Duration(req.TimeoutMS) * time.Millisecond
+		if e.maxTimeout > 0 && timeout > e.maxTimeout {
+			timeout = e.maxTimeout
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runScript(ctx, e, stmts, req.ContinueOnError, verboseErrors))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// selfTestCase is one entry of the SELF_TEST_FILE: a query and the
+// columns and rows it must return. Columns may be omitted to check rows
+// only.
+type selfTestCase struct {
+	SQL     string          `json:"sql"`
+	Columns []string        `json:"columns,omitempty"`
+	Rows    json.RawMessage `json:"rows"`
+}
+
+// loadSelfTests reads the JSON array of self-test cases at path.
+func loadSelfTests(path string) ([]selfTestCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []selfTestCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("self-tests %s: %w", path, err)
+	}
+	for i, c := range cases {
+		if c.SQL == "" || c.Rows == nil {
+			return nil, fmt.Errorf("self-test %d: sql and rows are required", i)
+		}
+	}
+	return cases, nil
+}
+
+// runSelfTests runs every case against e and returns an error describing
+// the first one whose result differs from what is expected. Rows are
+// compared as decoded JSON, so 1 and 1.0 are equal.
+func runSelfTests(ctx context.Context, e *Engine, cases []selfTestCase) error {
+	for i, c := range cases {
+		resp, err := runQuery(ctx, e, QueryRequest{SQL: c.SQL})
+		if err != nil {
+			return fmt.Errorf("self-test %d (%s): %w", i, c.SQL, err)
+		}
+		if c.Columns != nil && !reflect.DeepEqual(c.Columns, resp.Columns) {
+			return fmt.Errorf("self-test %d (%s): expected columns %q, got %q", i, c.SQL, c.Columns, resp.Columns)
+		}
+		var want, got interface{}
+		if err := json.Unmarshal(c.Rows, &want); err != nil {
+			return fmt.Errorf("self-test %d (%s): rows: %w", i, c.SQL, err)
+		}
+		rows := resp.Rows
+		if rows == nil {
+			rows = [][]interface{}{}
+		}
+		data, _ := json.Marshal(rows)
+		json.Unmarshal(data, &got)
+		if !reflect.DeepEqual(want, got) {
+			return fmt.Errorf("self-test %d (%s): expected rows %s, got %s", i, c.SQL, c.Rows, data)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// spillConfig enables spilling buffered JSON responses to a temporary
+// file once they grow past threshold bytes. A zero threshold keeps
+// responses in memory.
+type spillConfig struct {
+	threshold int
+	dir       string
+}
+
+// spillConfigFromEnv reads SPILL_THRESHOLD_BYTES and SPILL_DIR, which
+// defaults to the system temp directory.
+func spillConfigFromEnv() spillConfig {
+	n, _ := strconv.Atoi(os.Getenv("SPILL_THRESHOLD_BYTES"))
+	return spillConfig{threshold: max(n, 0), dir: os.Getenv("SPILL_DIR")}
+}
+
+// spillBuffer collects a response body in memory until it would exceed
+// the threshold, then moves it to a temporary file and appends there.
+// Close removes the file, so callers defer it straight after creation.
+// When limit is positive, a write that would take the body past it is
+// rejected unwritten with ErrResponseTooLarge, so an oversized response
+// is neither encoded in full nor copied to disk.
+type spillBuffer struct {
+	cfg   spillConfig
+	limit int
+	mem   bytes.Buffer
+	file  *os.File
+	n     int
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && b.n+len(p) > b.limit {
+		return 0, fmt.Errorf("%w: exceeds limit of %d bytes", ErrResponseTooLarge, b.limit)
+	}
+	if b.file == nil && b.cfg.threshold > 0 && b.mem.Len()+len(p) > b.cfg.threshold {
+		f, err := os.CreateTemp(b.cfg.dir, "minisql-spill-*.json")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		if _, err := b.mem.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.n += n
+	return n, err
+}
+
+// Len is the number of bytes written so far.
+func (b *spillBuffer) Len() int { return b.n }
+
+// WriteTo copies the whole body to w.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.file == nil {
+		return b.mem.WriteTo(w)
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, b.file)
+}
+
+// Close deletes the temporary file, if one was created.
+func (b *spillBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	name := b.file.Name()
+	b.file.Close()
+	b.file = nil
+	return os.Remove(name)
+}
+
+// rowsMarker stands in for the rows while the rest of a response is
+// marshalled, so encodeRowsJSON can splice the real rows in one at a time.
+const rowsMarker = "\x00rows\x00"
+
+// encodeRowsJSON writes body, a response built from resp by wrap, as
+// json.Encoder would, but encodes resp.Rows one row at a time so the full
+// row array is never held as a single encoded value. This is what keeps
+// spilling worthwhile for large results.
+func encodeRowsJSON(w io.Writer, resp QueryResponse, wrap func(QueryResponse) interface{}) error {
+	if len(resp.Rows) == 0 {
+		return json.NewEncoder(w).Encode(wrap(resp))
+	}
+	marked := resp
+	marked.Rows = [][]interface{}{{rowsMarker}}
+	data, err := json.Marshal(wrap(marked))
+	if err != nil {
+		return err
+	}
+	markerJSON, _ := json.Marshal(marked.Rows)
+	head, tail, _ := bytes.Cut(data, markerJSON)
+	if _, err := w.Write(append(head, '[')); err != nil {
+		return err
+	}
+	for i, row := range resp.Rows {
+		enc, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			enc = append([]byte{','}, enc...)
+		}
+		if _, err := w.Write(enc); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(append(append([]byte{']'}, tail...), '\n'))
+	return err
+}
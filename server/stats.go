@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats holds the process-wide counters reported by /stats.
+type serverStats struct {
+	queries       atomic.Int64
+	errors        atomic.Int64
+	inFlight      atomic.Int64
+	retries       atomic.Int64
+	coalesced     atomic.Int64
+	logSampleRate atomic.Int64
+}
+
+var stats serverStats
+
+// StatsResponse is the body returned by /stats.
+type StatsResponse struct {
+	Queries       int64 `json:"queries"`
+	Errors        int64 `json:"errors"`
+	InFlight      int64 `json:"in_flight"`
+	Retries       int64 `json:"retries"`
+	Coalesced     int64 `json:"coalesced"`
+	LogSampleRate int64 `json:"log_sample_rate"`
+}
+
+func (s *serverStats) snapshot() StatsResponse {
+	return StatsResponse{
+		Queries:       s.queries.Load(),
+		Errors:        s.errors.Load(),
+		InFlight:      s.inFlight.Load(),
+		Retries:       s.retries.Load(),
+		Coalesced:     s.coalesced.Load(),
+		LogSampleRate: s.logSampleRate.Load(),
+	}
+}
+
+func handleStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.snapshot())
+	}
+}
+
+// querySampler decides which queries are written to the audit log. Every
+// rate-th successful query is logged; errors and queries slower than slow
+// are always logged. A rate of 1 or less logs everything.
+type querySampler struct {
+	rate int
+	slow time.Duration
+	n    atomic.Uint64
+}
+
+func (s *querySampler) shouldLog(elapsed time.Duration, err error) bool {
+	if err != nil || s.rate <= 1 || (s.slow > 0 && elapsed >= s.slow) {
+		return true
+	}
+	return s.n.Add(1)%uint64(s.rate) == 1
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RunRequest is the body of POST /run/{name}. Params supplies a value for
+// every :name placeholder in the template, Args one for each ? in order.
+type RunRequest struct {
+	Params    map[string]interface{} `json:"params,omitempty"`
+	Args      []interface{}          `json:"args,omitempty"`
+	Limit     int                    `json:"limit,omitempty"`
+	Offset    int                    `json:"offset,omitempty"`
+	TimeoutMS int                    `json:"timeout_ms,omitempty"`
+}
+
+// queryTemplate is a parsed template: the literal SQL between
+// placeholders in parts, and the placeholders in order, so that
+// parts[0] slots[0] parts[1] ... parts[len(slots)] rebuilds the source.
+type queryTemplate struct {
+	parts []string
+	slots []placeholder
+}
+
+// placeholder is one :name or ? in a template. name is empty for ?.
+// intOnly is set when it directly follows LIMIT or OFFSET, where the
+// engine accepts only a non-negative integer.
+type placeholder struct {
+	name    string
+	intOnly bool
+}
+
+// loadTemplates reads the JSON object of name -> SQL at path and parses
+// every template, so a malformed one stops the server at startup rather
+// than failing on first use.
+func loadTemplates(path string) (map[string]queryTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("templates %s: %w", path, err)
+	}
+	templates := make(map[string]queryTemplate, len(raw))
+	for name, sql := range raw {
+		if !validTemplateName(name) {
+			return nil, fmt.Errorf("template %q: name must use only letters, digits, '-' and '_'", name)
+		}
+		t, err := parseTemplate(sql)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", name, err)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+func validTemplateName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !isIdentRune(c) && c != '-' && !(c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentRune(c rune) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// parseTemplate splits sql at :name and ? placeholders. Colons and
+// question marks inside string literals, and "::", are left alone. A
+// template uses either named or positional placeholders, not both.
+func parseTemplate(sql string) (queryTemplate, error) {
+	if strings.TrimSpace(sql) == "" {
+		return queryTemplate{}, fmt.Errorf("empty SQL")
+	}
+	var t queryTemplate
+	src := []rune(sql)
+	inString := false
+	last := 0
+	add := func(i, j int, name string) {
+		part := string(src[last:i])
+		t.parts = append(t.parts, part)
+		t.slots = append(t.slots, placeholder{name: name, intOnly: followsLimit(part)})
+		last = j
+	}
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == '\'':
+			inString = !inString
+		case inString:
+		case c == '?':
+			add(i, i+1, "")
+		case c != ':':
+		case i+1 < len(src) && src[i+1] == ':':
+			i++
+		case i+1 < len(src) && isIdentRune(src[i+1]):
+			j := i + 1
+			for j < len(src) && (isIdentRune(src[j]) || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			add(i, j, string(src[i+1:j]))
+			i = j - 1
+		}
+	}
+	if inString {
+		return queryTemplate{}, fmt.Errorf("unterminated string literal")
+	}
+	t.parts = append(t.parts, string(src[last:]))
+	named, positional := false, false
+	for _, s := range t.slots {
+		named = named || s.name != ""
+		positional = positional || s.name == ""
+	}
+	if named && positional {
+		return queryTemplate{}, fmt.Errorf("cannot mix :name and ? placeholders")
+	}
+	return t, nil
+}
+
+// followsLimit reports whether the SQL before a placeholder ends with the
+// LIMIT or OFFSET keyword.
+func followsLimit(part string) bool {
+	fields := strings.Fields(part)
+	if len(fields) == 0 {
+		return false
+	}
+	last := strings.ToUpper(fields[len(fields)-1])
+	return last == "LIMIT" || last == "OFFSET"
+}
+
+// bind substitutes params and args into t as SQL literals. Every
+// placeholder must have a value and every param and arg must be used.
+// LIMIT and OFFSET placeholders take only non-negative integers.
+func (t queryTemplate) bind(params map[string]interface{}, args []interface{}) (string, error) {
+	used := make(map[string]bool, len(t.slots))
+	next := 0
+	var b strings.Builder
+	for i, s := range t.slots {
+		var v interface{}
+		label := fmt.Sprintf("%q", s.name)
+		if s.name == "" {
+			label = fmt.Sprintf("%d", next+1)
+			if next >= len(args) {
+				return "", fmt.Errorf("missing arg %s", label)
+			}
+			v = args[next]
+			next++
+		} else {
+			var ok bool
+			if v, ok = params[s.name]; !ok {
+				return "", fmt.Errorf("missing param %s", label)
+			}
+			used[s.name] = true
+		}
+		if s.intOnly && !isCount(v) {
+			return "", fmt.Errorf("param %s: LIMIT and OFFSET need a non-negative integer, got %v", label, v)
+		}
+		lit, err := sqlLiteral(v)
+		if err != nil {
+			return "", fmt.Errorf("param %s: %w", label, err)
+		}
+		b.WriteString(t.parts[i])
+		b.WriteString(lit)
+	}
+	b.WriteString(t.parts[len(t.slots)])
+	if next < len(args) {
+		return "", fmt.Errorf("got %d args, template takes %d", len(args), next)
+	}
+
+	var unknown []string
+	for name := range params {
+		if !used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return "", fmt.Errorf("unknown params: %s", strings.Join(unknown, ", "))
+	}
+	return b.String(), nil
+}
+
+// sqlLiteral renders a decoded JSON scalar as a SQL literal. Strings are
+// single-quoted with embedded quotes doubled, which the engine reads back
+// as one quote, so a value can never end the literal early. The engine
+// has only integers, so a number must be written as a whole number that
+// fits in 64 bits; it is bound digit for digit, never via float64.
+func sqlLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return "", fmt.Errorf("number %s is not a 64-bit integer", v)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'", nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", v)
+}
+
+// isCount reports whether v decoded from JSON as a whole number >= 0.
+func isCount(v interface{}) bool {
+	n, ok := v.(json.Number)
+	if !ok {
+		return false
+	}
+	i, err := n.Int64()
+	return err == nil && i >= 0
+}
+
+// handleRun serves POST /run/{name}, executing a registered template with
+// the params from the body. Clients never send SQL of their own.
+func handleRun(e *Engine, templates map[string]queryTemplate) http.HandlerFunc {
+	token := os.Getenv("API_TOKEN")
+	devMode := os.Getenv("DEV_MODE") == "1"
+	verboseErrors := verboseErrorsFromEnv()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token, devMode) {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/run/")
+		t, ok := templates[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown template %q", name))
+			return
+		}
+
+		// Numbers stay json.Number so integers past 2^53 are bound
+		// exactly rather than rounded through float64.
+		var req RunRequest
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sql, err := t.bind(req.Params, req.Args)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		resp, err := runQuery(r.Context(), e, QueryRequest{
+			SQL:       sql,
+			Limit:     req.Limit,
+			Offset:    req.Offset,
+			TimeoutMS: req.TimeoutMS,
+		})
+		if err != nil {
+			writeQueryError(w, err, sql, verboseErrors)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}